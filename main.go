@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"image-rbac-proxy/pkg/apikeys"
+	"image-rbac-proxy/pkg/audit"
+	"image-rbac-proxy/pkg/blobcache"
 	"image-rbac-proxy/pkg/handlers"
+	"image-rbac-proxy/pkg/manifestcache"
 	mw "image-rbac-proxy/pkg/middleware"
+	"image-rbac-proxy/pkg/ratelimit"
+	"image-rbac-proxy/pkg/server"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
@@ -20,43 +27,132 @@ func main() {
 	level, _ := logrus.ParseLevel("info")
 	logrus.SetLevel(level)
 
-	// Initializa memcache
-	utils.InitCacheClient(strings.Split(os.Getenv("MEMCACHE_SERVERS"), ","))
+	// Setup tracing
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		logrus.Fatalf("Unable to initialize tracing: %s", err)
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	// Setup audit sinks
+	if err := audit.InitFromEnv(); err != nil {
+		logrus.Fatalf("Unable to initialize audit: %s", err)
+	}
+	if audit.DefaultAuditor != nil {
+		defer func() { _ = audit.DefaultAuditor.Close() }()
+	}
+
+	// Initialize cache
+	if err := utils.InitCacheFromEnv(); err != nil {
+		logrus.Fatalf("Unable to initialize cache: %s", err)
+	}
+
+	// Setup API keys
+	if err := apikeys.InitFromEnv(context.Background()); err != nil {
+		logrus.Fatalf("Unable to load API keys: %s", err)
+	}
+
+	// Setup client authentication
+	mw.BasicAuth = utils.EnvBool("BASIC_AUTH", true)
+	if err := mw.InitClientCertFromEnv(); err != nil {
+		logrus.Fatalf("Unable to configure client certificate mapping: %s", err)
+	}
+
+	// Setup trusted proxies
+	if err := utils.InitTrustedProxiesFromEnv(); err != nil {
+		logrus.Fatalf("Unable to configure trusted proxies: %s", err)
+	}
+
+	// Setup transport to backend registries
+	if err := utils.InitTransportFromEnv(); err != nil {
+		logrus.Fatalf("Unable to configure backend transport: %s", err)
+	}
 
 	// Setup backend from config
-	initBackendProxy()
+	backend := initBackendProxy()
+
+	// Setup rate limits
+	limiter, err := ratelimit.NewLimiterFromEnv()
+	if err != nil {
+		logrus.Fatalf("Unable to load rate limits: %s", err)
+	}
+
+	// Setup blob cache
+	blobs, err := blobcache.NewStoreFromEnv()
+	if err != nil {
+		logrus.Fatalf("Unable to open blob cache: %s", err)
+	}
+	// Passed through redirects send clients to the storage directly, so the blob cache would never be filled
+	if blobs != nil && !backend.FollowsRedirects() {
+		logrus.Fatal("BLOB_CACHE_DIR requires the backend to follow redirects, set BACKEND_REDIRECTS=follow")
+	}
+
+	// Setup manifest cache
+	manifests := manifestcache.NewFromEnv(utils.CacheClient)
 
 	// Setup handlers
 	proxy := http.NewServeMux()
 	registryHandler := http.HandlerFunc(handlers.RegistryHandler)
-	chainedHandler := mw.Authz(registryHandler)
+	chainedHandler := mw.ClientRateLimit(limiter, mw.Authz(mw.RateLimit(limiter, mw.ManifestCache(manifests, mw.BlobCache(blobs, registryHandler)))))
 	proxy.Handle("/v2/", chainedHandler)
 	proxy.HandleFunc("/_ping", handlers.PingHandler)
-	proxy.HandleFunc("/auth", handlers.AuthHandler)
+	proxy.HandleFunc("/_ready", handlers.ReadyHandler)
+	// Token requests verify credentials against the API server, so limit them like registry requests
+	proxy.Handle("/auth", mw.ClientRateLimit(limiter, http.HandlerFunc(handlers.AuthHandler)))
 	proxy.HandleFunc("/oauth", handlers.OauthHandler)
 	proxy.HandleFunc("/oauth/callback", handlers.OauthCallbackHandler)
 
-	// Configure server based on settings
-	bind := "0.0.0.0:4000"
+	// Configure listeners based on settings
+	listeners, err := server.ListenersFromEnv()
+	if err != nil {
+		logrus.Fatalf("Unable to configure listeners: %s", err)
+	}
 	lw := logrus.StandardLogger().Writer()
 	defer func() { _ = lw.Close() }()
-	srv := &http.Server{
-		Addr:              bind,
-		Handler:           proxy,
-		ErrorLog:          log.New(lw, "", 0),
-		ReadHeaderTimeout: 10 * time.Second,
-	}
+	cfg := server.ConfigFromEnv(tracing.Handler(mw.AccessLog(mw.Metrics(proxy))), log.New(lw, "", 0))
 
-	// Start server
-	logrus.Printf("Listening on %s", bind)
-	logrus.Fatal(srv.ListenAndServeTLS("/certs/tls.crt", "/certs/tls.key"))
+	// Start servers
+	logrus.Fatal(server.Serve(context.Background(), listeners, cfg))
 }
 
-func initBackendProxy() {
-	url := os.Getenv("BACKEND_URL")
-	username := os.Getenv("QUAY_USERNAME")
-	password := os.Getenv("QUAY_PASSWORD")
+func initBackendProxy() *handlers.BackendConfig {
+	cfg, err := backendConfig()
+	if err != nil {
+		logrus.Fatalf("Unable to configure backend: %s", err)
+	}
+
+	bp, err := handlers.NewBackendFromConfig(context.Background(), cfg)
+	if err != nil {
+		logrus.Fatalf("Unable to configure backend: %s", err)
+	}
 
-	logrus.Printf("Adding registry backend with URL %s", url)
-	handlers.BackendRegistry = &handlers.BackendProxy{URL: url, Auth: handlers.NewTokenAuth(username, password)}
+	for _, u := range cfg.Upstreams {
+		logrus.Printf("Adding registry backend with URL %s", u.URL)
+	}
+	handlers.BackendRegistry = bp
+	return cfg
+}
+
+// backendConfig loads the backend upstreams from BACKEND_CONFIG, or a single upstream from the environment
+func backendConfig() (*handlers.BackendConfig, error) {
+	if path := os.Getenv("BACKEND_CONFIG"); path != "" {
+		return handlers.LoadBackendConfig(path)
+	}
+	return &handlers.BackendConfig{Upstreams: []handlers.UpstreamConfig{{
+		URL: os.Getenv("BACKEND_URL"),
+		Auth: handlers.AuthConfig{
+			Type:               os.Getenv("BACKEND_AUTH_TYPE"),
+			Username:           os.Getenv("QUAY_USERNAME"),
+			Password:           os.Getenv("QUAY_PASSWORD"),
+			Token:              os.Getenv("BACKEND_TOKEN"),
+			UsernameFile:       os.Getenv("QUAY_USERNAME_FILE"),
+			PasswordFile:       os.Getenv("QUAY_PASSWORD_FILE"),
+			TokenFile:          os.Getenv("BACKEND_TOKEN_FILE"),
+			CredentialsSecret:  os.Getenv("BACKEND_CREDENTIALS_SECRET"),
+			DockerConfigPath:   os.Getenv("BACKEND_DOCKERCONFIG_PATH"),
+			DockerConfigSecret: os.Getenv("BACKEND_DOCKERCONFIG_SECRET"),
+			Endpoint:           os.Getenv("BACKEND_AUTH_ENDPOINT"),
+		},
+		Redirects: os.Getenv("BACKEND_REDIRECTS"),
+	}}}, nil
 }
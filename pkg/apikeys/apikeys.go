@@ -0,0 +1,369 @@
+// Package apikeys verifies long-lived API keys managed by the proxy.
+//
+// API keys have the form irp_<id>_<secret>, where the secret is 32 or more hex characters.
+// They are stored hashed in a Kubernetes Secret or ConfigMap with one entry per key ID:
+//
+//	ci-bot: |
+//	  hash: <hex sha256 of the secret>
+//	  user: ci-bot
+//	  groups: [ci]
+//	  namespaces: [team-a]
+//	  expiresAt: "2027-01-01T00:00:00Z"
+//
+// Keys are revoked by setting revoked: true or by deleting the entry, which takes effect on the next reload.
+//
+// The last use of each key is recorded in a last-used.image-rbac-proxy/<id> annotation of the Secret or ConfigMap,
+// at most once per API_KEYS_LAST_USED_INTERVAL for each key. The proxy needs get and patch permissions on it,
+// which deploy/base grants for the image-rbac-proxy-api-keys Secret.
+package apikeys
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// Prefix identifies API keys among tokens
+const Prefix = "irp_"
+
+// LastUsedAnnotation prefixes the annotations recording when each key was last used
+const LastUsedAnnotation = "last-used.image-rbac-proxy/"
+
+// Minimum time between two records of the use of a key, so that requests do not each write to the API server
+const (
+	defaultLastUsedInterval = 10 * time.Minute
+	minLastUsedInterval     = time.Minute
+)
+
+// Sources API keys are read from
+const (
+	SourceSecret    = "secret"
+	SourceConfigMap = "configmap"
+)
+
+var (
+	ErrInvalid = errors.New("API key is invalid")
+	ErrExpired = errors.New("API key has expired")
+	ErrRevoked = errors.New("API key has been revoked")
+)
+
+var (
+	// Key IDs are valid annotation names so their last use can be recorded
+	idMatch     = regexp.MustCompile(`^[A-Za-z0-9]([-.A-Za-z0-9]{0,61}[A-Za-z0-9])?$`)
+	secretMatch = regexp.MustCompile(`^[0-9a-f]{32,}$`)
+)
+
+// Key is an API key record bound to a Kubernetes identity
+type Key struct {
+	ID string `json:"-"`
+	// Hash is the hex encoded SHA-256 of the secret part of the key
+	Hash   string   `json:"hash"`
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+	// Namespaces restricts the key to these namespaces, all namespaces are allowed if empty
+	Namespaces []string   `json:"namespaces,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Revoked    bool       `json:"revoked,omitempty"`
+}
+
+// Allows reports whether the key may be used to access a namespace
+func (k *Key) Allows(namespace string) bool {
+	return len(k.Namespaces) == 0 || slices.Contains(k.Namespaces, namespace)
+}
+
+// Parse parses the entries of a Secret or ConfigMap into keys by ID
+func Parse(data map[string][]byte) (map[string]*Key, error) {
+	keys := make(map[string]*Key, len(data))
+	for id, entry := range data {
+		if !idMatch.MatchString(id) {
+			return nil, fmt.Errorf("invalid API key id %q", id)
+		}
+		var k Key
+		if err := yaml.UnmarshalStrict(entry, &k); err != nil {
+			return nil, fmt.Errorf("unable to parse API key %s: %s", id, err)
+		}
+		if _, err := hex.DecodeString(k.Hash); err != nil || len(k.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("API key %s must have a hex encoded SHA-256 hash", id)
+		}
+		if k.User == "" {
+			return nil, fmt.Errorf("API key %s has no user", id)
+		}
+		k.ID, k.Hash = id, strings.ToLower(k.Hash)
+		keys[id] = &k
+	}
+	return keys, nil
+}
+
+// Store holds the API keys of a Secret or ConfigMap and tracks when each was last used
+type Store struct {
+	source string
+	ref    string
+	mu     sync.RWMutex
+	keys   map[string]*Key
+	// lastUsed caches the last use of each key, as loaded from the annotations or recorded since
+	lastUsed map[string]time.Time
+	interval time.Duration
+	now      func() time.Time
+}
+
+// DefaultStore is the store used by the handlers, nil when API keys are disabled
+var DefaultStore *Store
+
+// New constructs a Store holding a fixed set of keys
+func New(keys map[string]*Key) *Store {
+	return &Store{keys: keys, lastUsed: map[string]time.Time{}, interval: defaultLastUsedInterval, now: time.Now}
+}
+
+// NewStore constructs a Store reading keys from a Secret or ConfigMap given as namespace/name
+func NewStore(ctx context.Context, source, ref string) (*Store, error) {
+	if source != SourceSecret && source != SourceConfigMap {
+		return nil, fmt.Errorf("unsupported API key source %q", source)
+	}
+	s := New(nil)
+	s.source, s.ref = source, ref
+	if err := s.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// InitFromEnv sets DefaultStore from API_KEYS_SECRET or API_KEYS_CONFIGMAP and reloads it every API_KEYS_REFRESH_INTERVAL.
+// The use of a key is recorded at most once per API_KEYS_LAST_USED_INTERVAL, and at most once a minute.
+// API keys are disabled when neither is set.
+func InitFromEnv(ctx context.Context) error {
+	source, ref := SourceSecret, os.Getenv("API_KEYS_SECRET")
+	if ref == "" {
+		source, ref = SourceConfigMap, os.Getenv("API_KEYS_CONFIGMAP")
+	}
+	if ref == "" {
+		return nil
+	}
+	s, err := NewStore(ctx, source, ref)
+	if err != nil {
+		return err
+	}
+	s.interval = max(utils.EnvDuration("API_KEYS_LAST_USED_INTERVAL", defaultLastUsedInterval), minLastUsedInterval)
+	go s.Watch(ctx, utils.EnvDuration("API_KEYS_REFRESH_INTERVAL", 30*time.Second))
+	DefaultStore = s
+	return nil
+}
+
+// Reload replaces the keys with the current contents of the Secret or ConfigMap
+func (s *Store) Reload(ctx context.Context) error {
+	data, annotations, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	for name, value := range annotations {
+		id, ok := strings.CutPrefix(name, LastUsedAnnotation)
+		if !ok {
+			continue
+		}
+		used, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logrus.Warnf("Ignoring invalid last use of API key %s: %s", id, err)
+			continue
+		}
+		if used.After(s.lastUsed[id]) {
+			s.lastUsed[id] = used
+		}
+	}
+	return nil
+}
+
+// Watch reloads the keys until ctx is done, keeping the current keys if a reload fails
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Reload(ctx); err != nil {
+			logrus.Errorf("Unable to reload API keys: %s", err)
+		}
+	}
+}
+
+// client returns a Kubernetes client and the namespace and name of the Secret or ConfigMap
+func (s *Store) client() (*kubernetes.Clientset, string, string, error) {
+	namespace, name, ok := strings.Cut(s.ref, "/")
+	if !ok {
+		return nil, "", "", fmt.Errorf("%s %q must be in the form namespace/name", s.source, s.ref)
+	}
+	config := &rest.Config{
+		Host:        os.Getenv("CLUSTER_URL"),
+		BearerToken: os.Getenv("OAUTH_TOKEN"),
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error creating Kubernetes client: %s", err)
+	}
+	return client, namespace, name, nil
+}
+
+// fetch reads the entries and annotations of the Secret or ConfigMap
+func (s *Store) fetch(ctx context.Context) (map[string][]byte, map[string]string, error) {
+	client, namespace, name, err := s.client()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.source == SourceSecret {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get secret %s: %s", s.ref, err)
+		}
+		return secret.Data, secret.Annotations, nil
+	}
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get configmap %s: %s", s.ref, err)
+	}
+	data := make(map[string][]byte, len(cm.Data))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	return data, cm.Annotations, nil
+}
+
+// recordLastUsed stores the last use of a key in its annotation
+func (s *Store) recordLastUsed(ctx context.Context, id string, used time.Time) error {
+	client, namespace, name, err := s.client()
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{LastUsedAnnotation + id: used.UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.source == SourceSecret {
+		_, err = client.CoreV1().Secrets(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = client.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to record last use of API key %s in %s %s: %s", id, s.source, s.ref, err)
+	}
+	return nil
+}
+
+// IsAPIKey reports whether a token has the form of an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// Verify returns the key record of a valid API key and records its use.
+// Uses are recorded in the background, at most once per interval for each key.
+func (s *Store) Verify(apiKey string) (*Key, error) {
+	k, err := s.lookup(apiKey)
+	result := "valid"
+	switch {
+	case errors.Is(err, ErrExpired):
+		result = "expired"
+	case errors.Is(err, ErrRevoked):
+		result = "revoked"
+	case err != nil:
+		result = "invalid"
+	}
+	metrics.APIKeyVerifications.WithLabelValues(result).Inc()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	record := now.Sub(s.lastUsed[k.ID]) >= s.interval
+	if record {
+		s.lastUsed[k.ID] = now
+	}
+	s.mu.Unlock()
+	if record && s.source != "" {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.recordLastUsed(ctx, k.ID, now); err != nil {
+				logrus.Warn(err)
+			}
+		}()
+	}
+	return k, nil
+}
+
+func (s *Store) lookup(apiKey string) (*Key, error) {
+	if s == nil || !IsAPIKey(apiKey) {
+		return nil, ErrInvalid
+	}
+	id, secret, ok := cutLast(strings.TrimPrefix(apiKey, Prefix), "_")
+	if !ok || !secretMatch.MatchString(secret) {
+		return nil, ErrInvalid
+	}
+
+	s.mu.RLock()
+	k, found := s.keys[id]
+	s.mu.RUnlock()
+	if !found {
+		return nil, ErrInvalid
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(k.Hash)) != 1 {
+		return nil, ErrInvalid
+	}
+	if k.Revoked {
+		return nil, ErrRevoked
+	}
+	if k.ExpiresAt != nil && !s.now().Before(*k.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	return k, nil
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// LastUsed returns when a key was last recorded as used, by this process or in its annotation
+func (s *Store) LastUsed(id string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.lastUsed[id]
+	return t, ok
+}
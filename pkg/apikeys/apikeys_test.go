@@ -0,0 +1,200 @@
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func hashOf(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParse(t *testing.T) {
+	parseTests := []struct {
+		name    string
+		data    map[string][]byte
+		wantErr bool
+	}{
+		{"Valid key", map[string][]byte{"ci-bot": []byte("hash: " + hashOf(testSecret) + "\nuser: ci-bot\ngroups: [ci]\nnamespaces: [team-a]\nexpiresAt: \"2030-01-01T00:00:00Z\"\n")}, false},
+		{"Invalid id", map[string][]byte{"ci_bot": []byte("hash: " + hashOf(testSecret) + "\nuser: ci-bot\n")}, true},
+		{"Id too long for an annotation", map[string][]byte{strings.Repeat("a", 64): []byte("hash: " + hashOf(testSecret) + "\nuser: ci-bot\n")}, true},
+		{"Invalid hash", map[string][]byte{"ci-bot": []byte("hash: secret\nuser: ci-bot\n")}, true},
+		{"Missing user", map[string][]byte{"ci-bot": []byte("hash: " + hashOf(testSecret) + "\n")}, true},
+		{"Unknown field", map[string][]byte{"ci-bot": []byte("hash: " + hashOf(testSecret) + "\nuser: ci-bot\nrole: admin\n")}, true},
+	}
+
+	for _, tt := range parseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %t, but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	s := New(map[string]*Key{
+		"ci-bot":  {ID: "ci-bot", Hash: hashOf(testSecret), User: "ci-bot", ExpiresAt: &future},
+		"expired": {ID: "expired", Hash: hashOf(testSecret), User: "old-bot", ExpiresAt: &past},
+		"revoked": {ID: "revoked", Hash: hashOf(testSecret), User: "bad-bot", Revoked: true},
+	})
+	s.now = func() time.Time { return now }
+
+	verifyTests := []struct {
+		name     string
+		key      string
+		wantUser string
+		wantErr  error
+	}{
+		{"Valid key", "irp_ci-bot_" + testSecret, "ci-bot", nil},
+		{"Wrong secret", "irp_ci-bot_" + hashOf("other"), "", ErrInvalid},
+		{"Unknown id", "irp_other_" + testSecret, "", ErrInvalid},
+		{"Expired key", "irp_expired_" + testSecret, "", ErrExpired},
+		{"Revoked key", "irp_revoked_" + testSecret, "", ErrRevoked},
+		{"Malformed key", "irp_" + testSecret, "", ErrInvalid},
+		{"Not a key", "ci-bot_" + testSecret, "", ErrInvalid},
+	}
+
+	for _, tt := range verifyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := s.Verify(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected error %v, but got %v", tt.wantErr, err)
+			}
+			if err == nil && k.User != tt.wantUser {
+				t.Errorf("Expected user %s, but got %s", tt.wantUser, k.User)
+			}
+		})
+	}
+
+	if used, ok := s.LastUsed("ci-bot"); !ok || !used.Equal(now) {
+		t.Errorf("Expected ci-bot to be last used at %s, but got %s", now, used)
+	}
+	if _, ok := s.LastUsed("expired"); ok {
+		t.Error("Expected expired key not to be recorded as used")
+	}
+
+	// Uses are recorded at most once per interval
+	later := now.Add(defaultLastUsedInterval / 2)
+	s.now = func() time.Time { return later }
+	_, _ = s.Verify("irp_ci-bot_" + testSecret)
+	if used, _ := s.LastUsed("ci-bot"); !used.Equal(now) {
+		t.Errorf("Expected use within the interval not to be recorded, but got %s", used)
+	}
+	later = now.Add(defaultLastUsedInterval)
+	_, _ = s.Verify("irp_ci-bot_" + testSecret)
+	if used, _ := s.LastUsed("ci-bot"); !used.Equal(later) {
+		t.Errorf("Expected ci-bot to be last used at %s, but got %s", later, used)
+	}
+	if _, err := (*Store)(nil).Verify("irp_ci-bot_" + testSecret); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected keys to be rejected when disabled, but got %v", err)
+	}
+}
+
+func TestKeyAllows(t *testing.T) {
+	k := &Key{Namespaces: []string{"team-a"}}
+	if !k.Allows("team-a") || k.Allows("team-b") {
+		t.Error("Expected key to be restricted to team-a")
+	}
+	if !(&Key{}).Allows("team-b") {
+		t.Error("Expected unrestricted key to allow any namespace")
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	entry := "hash: " + hashOf(testSecret) + "\nuser: ci-bot\n"
+	annotations := map[string]string{LastUsedAnnotation + "ci-bot": "2026-10-01T00:00:00Z"}
+	var revoked atomic.Bool
+	patches := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			patches <- r.URL.Path + " " + string(body)
+		}
+		var obj any
+		switch r.URL.Path {
+		case "/api/v1/namespaces/proxy/secrets/api-keys":
+			data := entry
+			if revoked.Load() {
+				data += "revoked: true\n"
+			}
+			obj = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}, Data: map[string][]byte{"ci-bot": []byte(data)}}
+		case "/api/v1/namespaces/proxy/configmaps/api-keys":
+			obj = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}, Data: map[string]string{"ci-bot": entry}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(obj)
+	}))
+	defer server.Close()
+	t.Setenv("CLUSTER_URL", server.URL)
+
+	for _, source := range []string{SourceSecret, SourceConfigMap} {
+		s, err := NewStore(t.Context(), source, "proxy/api-keys")
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		if used, _ := s.LastUsed("ci-bot"); !used.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected last use to be loaded from the %s annotation, but got %s", source, used)
+		}
+		now := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+		s.now = func() time.Time { return now }
+		if _, err := s.Verify("irp_ci-bot_" + testSecret); err != nil {
+			t.Errorf("Expected key from %s to be valid, but got %s", source, err)
+		}
+		want := `/api/v1/namespaces/proxy/` + source + `s/api-keys {"metadata":{"annotations":{"last-used.image-rbac-proxy/ci-bot":"2026-10-02T00:00:00Z"}}}`
+		select {
+		case patch := <-patches:
+			if patch != want {
+				t.Errorf("Expected patch %s, but got %s", want, patch)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the last use to be recorded in the %s", source)
+		}
+		// A second use within the interval is not recorded
+		_, _ = s.Verify("irp_ci-bot_" + testSecret)
+	}
+
+	s, err := NewStore(t.Context(), SourceSecret, "proxy/api-keys")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	revoked.Store(true)
+	if err := s.Reload(t.Context()); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if _, err := s.Verify("irp_ci-bot_" + testSecret); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected key to be revoked after reload, but got %v", err)
+	}
+
+	if len(patches) != 0 {
+		t.Errorf("Expected uses within the interval not to be recorded, but got %s", <-patches)
+	}
+
+	if _, err := NewStore(t.Context(), SourceSecret, "proxy/missing"); err == nil {
+		t.Error("Expected an error for a missing secret")
+	}
+	if _, err := NewStore(t.Context(), "vault", "proxy/api-keys"); err == nil {
+		t.Error("Expected an error for an unsupported source")
+	}
+}
@@ -0,0 +1,381 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+// Event types recorded by the proxy
+const (
+	EventAuthorization = "authorization"
+	EventTokenRequest  = "token_request"
+	// EventChainStart is recorded when an auditor starts, linking to the head persisted by the previous process
+	EventChainStart = "chain_start"
+	// EventChainGap is written to a sink in place of events it dropped, linking the events on either side of the gap
+	EventChainGap = "chain_gap"
+)
+
+// minKeySize is the minimum size of the key authenticating the chain
+const minKeySize = 32
+
+// Event is a single audit record.
+// Each event carries the HMAC of the previous one so that removed or altered records break the chain.
+type Event struct {
+	ID         string    `json:"id"`
+	Chain      string    `json:"chain"`
+	Timestamp  time.Time `json:"timestamp"`
+	Level      Level     `json:"level"`
+	Type       string    `json:"type"`
+	Subject    string    `json:"subject,omitempty"`
+	Groups     []string  `json:"groups,omitempty"`
+	Issuer     string    `json:"issuerType,omitempty"`
+	ClientIP   string    `json:"clientIP,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	// Dropped and Resume are set on chain gap events: the number of events dropped and the hash the next event links to
+	Dropped  int    `json:"dropped,omitempty"`
+	Resume   string `json:"resume,omitempty"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	Write(Event) error
+	Close() error
+}
+
+// Auditor applies the policy to events, chains them and fans them out to sinks.
+// Event hashes are HMACs keyed with a secret so the chain cannot be recomputed after editing the records.
+type Auditor struct {
+	policy   *Policy
+	key      []byte
+	sinks    []Sink
+	mu       sync.Mutex
+	chain    string
+	lastHash string
+	gaps     []sinkGap
+	// statePath persists the chain and its head so the chain continues across restarts
+	statePath string
+	// pending signals the persist loop that the head changed, done stops it and stopped is closed when it returned
+	pending chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// sinkGap tracks events a sink dropped since the last event it accepted
+type sinkGap struct {
+	dropped int
+	last    string
+}
+
+// chainState is the chain head persisted between restarts
+type chainState struct {
+	Chain string `json:"chain"`
+	Head  string `json:"head"`
+}
+
+// NewAuditor constructs an Auditor starting a new chain keyed with key
+func NewAuditor(policy *Policy, key []byte, sinks ...Sink) *Auditor {
+	return &Auditor{policy: policy, key: key, sinks: sinks, chain: newEventID(), gaps: make([]sinkGap, len(sinks))}
+}
+
+// Start records a chain start event. If statePath is set, the chain persisted there is resumed so the start
+// event links to the head written by the previous process. The head is persisted in the background as events are
+// written and flushed by Close, so after a crash the start event may link to an earlier head than the last event.
+func (a *Auditor) Start(statePath string) error {
+	reason := "new_chain"
+	if statePath != "" {
+		data, err := os.ReadFile(statePath) // #nosec G304 -- state path comes from trusted configuration
+		switch {
+		case err == nil:
+			var state chainState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("unable to parse audit chain state: %s", err)
+			}
+			a.chain, a.lastHash, reason = state.Chain, state.Head, "restart"
+			for i := range a.gaps {
+				a.gaps[i].last = a.lastHash
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("unable to read audit chain state: %s", err)
+		}
+		a.statePath = statePath
+		a.pending, a.done, a.stopped = make(chan struct{}, 1), make(chan struct{}), make(chan struct{})
+		go a.persistLoop()
+	}
+	a.write(Event{Type: EventChainStart, Level: LevelMetadata, Decision: utils.DecisionAllow, Reason: reason})
+	return nil
+}
+
+// DefaultAuditor is the auditor used by the handlers, nil when auditing is disabled
+var DefaultAuditor *Auditor
+
+// Record builds an event from the request and its RequestInfo and records it with DefaultAuditor
+func Record(eventType string, r *http.Request, info *utils.RequestInfo) {
+	if DefaultAuditor == nil {
+		return
+	}
+	DefaultAuditor.Record(Event{
+		Type:       eventType,
+		Subject:    info.Subject,
+		Groups:     info.Groups,
+		Issuer:     info.Issuer,
+		ClientIP:   utils.ClientIP(r),
+		Repository: info.Repository,
+		Namespace:  info.Namespace,
+		Decision:   info.Decision,
+		Reason:     info.Reason,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		UserAgent:  r.UserAgent(),
+	})
+}
+
+// Record applies the policy to the event and writes it to every sink
+func (a *Auditor) Record(e Event) {
+	level := a.policy.LevelFor(e)
+	if level == LevelNone {
+		return
+	}
+	if level == LevelMetadata {
+		e.Groups, e.Method, e.Path, e.UserAgent = nil, "", "", ""
+	}
+	e.Level = level
+	a.write(e)
+}
+
+// write links the event to the chain and writes it to every sink
+func (a *Auditor) write(e Event) {
+	e.ID = newEventID()
+	e.Timestamp = time.Now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Chain = a.chain
+	e.PrevHash = a.lastHash
+	e.Hash = ""
+	e.Hash = hashEvent(a.key, e)
+	a.lastHash = e.Hash
+	if a.pending != nil {
+		select {
+		case a.pending <- struct{}{}:
+		default:
+		}
+	}
+
+	for i, sink := range a.sinks {
+		a.writeSink(sink, &a.gaps[i], e)
+	}
+}
+
+// writeSink writes the event to a sink, preceded by a chain gap event if the sink dropped events before it.
+// Callers must hold a.mu.
+func (a *Auditor) writeSink(sink Sink, gap *sinkGap, e Event) {
+	if gap.dropped > 0 {
+		marker := Event{
+			ID:        newEventID(),
+			Chain:     a.chain,
+			Timestamp: e.Timestamp,
+			Level:     LevelMetadata,
+			Type:      EventChainGap,
+			Reason:    "events_dropped",
+			Dropped:   gap.dropped,
+			Resume:    e.PrevHash,
+			PrevHash:  gap.last,
+		}
+		marker.Hash = hashEvent(a.key, marker)
+		if err := sink.Write(marker); err != nil {
+			gap.dropped++
+			logrus.Errorf("Unable to write audit event: %s", err)
+			return
+		}
+		gap.dropped = 0
+	}
+	if err := sink.Write(e); err != nil {
+		gap.dropped++
+		logrus.Errorf("Unable to write audit event: %s", err)
+		return
+	}
+	gap.last = e.Hash
+}
+
+// persistLoop persists the chain head whenever it changed until Close is called
+func (a *Auditor) persistLoop() {
+	defer close(a.stopped)
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-a.pending:
+		}
+		if err := a.persist(); err != nil {
+			logrus.Errorf("Unable to persist audit chain head: %s", err)
+		}
+	}
+}
+
+// persist atomically writes the current chain head to statePath
+func (a *Auditor) persist() error {
+	a.mu.Lock()
+	state := chainState{Chain: a.chain, Head: a.lastHash}
+	a.mu.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := a.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.statePath)
+}
+
+// Close flushes the chain head and closes every sink
+func (a *Auditor) Close() error {
+	var errs []error
+	if a.done != nil {
+		close(a.done)
+		<-a.stopped
+		a.done = nil
+		if err := a.persist(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to persist audit chain head: %s", err))
+		}
+	}
+	for _, sink := range a.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyChain checks that the events of one chain are authentic and link to each other, returning the number of
+// events the sink reported as dropped through chain gap events.
+// anchor is the hash the first event must link to: empty for a new chain, or the last hash verified previously,
+// so events removed from the start of the log are detected.
+func VerifyChain(events []Event, key []byte, anchor string) (int, error) {
+	prev := anchor
+	dropped := 0
+	for i, e := range events {
+		if e.PrevHash != prev {
+			return dropped, fmt.Errorf("event %d (%s) does not link to the previous event", i, e.ID)
+		}
+		hash := e.Hash
+		e.Hash = ""
+		if !hmac.Equal([]byte(hashEvent(key, e)), []byte(hash)) {
+			return dropped, fmt.Errorf("event %d (%s) has been modified", i, e.ID)
+		}
+		prev = hash
+		if e.Type == EventChainGap {
+			// The next event links to the last event recorded before the gap
+			dropped += e.Dropped
+			prev = e.Resume
+		}
+	}
+	return dropped, nil
+}
+
+// hashEvent returns the HMAC-SHA256 of the event encoded without its hash
+func hashEvent(key []byte, e Event) string {
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadKey reads the key authenticating the chain from a file
+func LoadKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("audit HMAC key file is not specified")
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- key path comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit HMAC key: %s", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("audit HMAC key must be at least %d bytes", minKeySize)
+	}
+	return key, nil
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// InitFromEnv configures DefaultAuditor from AUDIT_* environment variables.
+// Auditing is disabled when AUDIT_SINKS is empty, otherwise AUDIT_HMAC_KEY_FILE is required.
+// The chain head is persisted to AUDIT_CHAIN_STATE_FILE, defaulting to AUDIT_FILE_PATH.head for the file sink.
+func InitFromEnv() error {
+	if os.Getenv("AUDIT_SINKS") == "" {
+		return nil
+	}
+	key, err := LoadKey(os.Getenv("AUDIT_HMAC_KEY_FILE"))
+	if err != nil {
+		return err
+	}
+
+	policy := DefaultPolicy()
+	if path := os.Getenv("AUDIT_POLICY_FILE"); path != "" {
+		p, err := LoadPolicy(path)
+		if err != nil {
+			return err
+		}
+		policy = p
+	}
+
+	var sinks []Sink
+	for _, name := range strings.Split(os.Getenv("AUDIT_SINKS"), ",") {
+		var sink Sink
+		var err error
+		switch strings.TrimSpace(name) {
+		case "stdout":
+			sink = NewWriterSink(os.Stdout)
+		case "file":
+			sink, err = NewFileSink(os.Getenv("AUDIT_FILE_PATH"), utils.EnvInt("AUDIT_FILE_MAX_SIZE_MB", 100), utils.EnvInt("AUDIT_FILE_MAX_BACKUPS", 5))
+		case "webhook":
+			sink, err = NewWebhookSink(os.Getenv("AUDIT_WEBHOOK_URL"))
+		default:
+			err = fmt.Errorf("unsupported audit sink %q", name)
+		}
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	auditor := NewAuditor(policy, key, sinks...)
+	statePath := os.Getenv("AUDIT_CHAIN_STATE_FILE")
+	if statePath == "" && os.Getenv("AUDIT_FILE_PATH") != "" {
+		statePath = os.Getenv("AUDIT_FILE_PATH") + ".head"
+	}
+	if statePath == "" {
+		logrus.Warn("AUDIT_CHAIN_STATE_FILE is not set, the audit chain restarts with every process")
+	}
+	if err := auditor.Start(statePath); err != nil {
+		return err
+	}
+	DefaultAuditor = auditor
+	return nil
+}
@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+type memorySink struct {
+	events []Event
+}
+
+func (s *memorySink) Write(e Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestAuditorChain(t *testing.T) {
+	sink := &memorySink{}
+	auditor := NewAuditor(DefaultPolicy(), testKey, sink)
+	for _, decision := range []string{utils.DecisionAllow, utils.DecisionDeny, utils.DecisionAllow} {
+		auditor.Record(Event{Type: EventAuthorization, Subject: "user1", Decision: decision})
+	}
+
+	if len(sink.events) != 3 {
+		t.Fatalf("Expected 3 events, but got %d", len(sink.events))
+	}
+	if _, err := VerifyChain(sink.events, testKey, ""); err != nil {
+		t.Errorf("Unexpected chain error %s", err)
+	}
+
+	tampered := append([]Event{}, sink.events...)
+	tampered[1].Decision = utils.DecisionAllow
+	if _, err := VerifyChain(tampered, testKey, ""); err == nil {
+		t.Error("Expected modified event to break the chain")
+	}
+
+	// Recomputing the hashes without the key does not produce a valid chain
+	rehashed := append([]Event{}, tampered...)
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	prev := ""
+	for i := range rehashed {
+		rehashed[i].PrevHash, rehashed[i].Hash = prev, ""
+		rehashed[i].Hash = hashEvent(otherKey, rehashed[i])
+		prev = rehashed[i].Hash
+	}
+	if _, err := VerifyChain(rehashed, testKey, ""); err == nil {
+		t.Error("Expected a chain rehashed without the key to be rejected")
+	}
+
+	removed := []Event{sink.events[0], sink.events[2]}
+	if _, err := VerifyChain(removed, testKey, ""); err == nil {
+		t.Error("Expected removed event to break the chain")
+	}
+
+	truncated := sink.events[1:]
+	if _, err := VerifyChain(truncated, testKey, ""); err == nil {
+		t.Error("Expected events removed from the start to break the chain")
+	}
+	if _, err := VerifyChain(truncated, testKey, sink.events[0].Hash); err != nil {
+		t.Errorf("Unexpected chain error from a verified anchor %s", err)
+	}
+}
+
+func TestAuditorStartResumesChain(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "audit.head")
+	sink := &memorySink{}
+
+	first := NewAuditor(DefaultPolicy(), testKey, sink)
+	if err := first.Start(statePath); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	first.Record(Event{Type: EventAuthorization, Subject: "user1", Decision: utils.DecisionAllow})
+	if err := first.Close(); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	// A restarted process continues the same chain
+	second := NewAuditor(DefaultPolicy(), testKey, sink)
+	if err := second.Start(statePath); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	second.Record(Event{Type: EventAuthorization, Subject: "user1", Decision: utils.DecisionDeny})
+
+	if len(sink.events) != 4 {
+		t.Fatalf("Expected 4 events, but got %d", len(sink.events))
+	}
+	if sink.events[0].Reason != "new_chain" || sink.events[2].Type != EventChainStart || sink.events[2].Reason != "restart" {
+		t.Errorf("Unexpected chain start events %+v %+v", sink.events[0], sink.events[2])
+	}
+	if sink.events[0].Chain != sink.events[3].Chain {
+		t.Errorf("Expected the chain to be resumed, but got %s and %s", sink.events[0].Chain, sink.events[3].Chain)
+	}
+	if _, err := VerifyChain(sink.events, testKey, ""); err != nil {
+		t.Errorf("Unexpected chain error %s", err)
+	}
+}
+
+func TestAuditorLevels(t *testing.T) {
+	levelTests := []struct {
+		name       string
+		level      Level
+		wantEvent  bool
+		wantGroups bool
+	}{
+		{"None", LevelNone, false, false},
+		{"Metadata", LevelMetadata, true, false},
+		{"Request", LevelRequest, true, true},
+	}
+
+	for _, tt := range levelTests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memorySink{}
+			auditor := NewAuditor(&Policy{Rules: []PolicyRule{{Level: tt.level}}}, testKey, sink)
+			auditor.Record(Event{Type: EventAuthorization, Subject: "user1", Groups: []string{"group1"}})
+
+			if got := len(sink.events) == 1; got != tt.wantEvent {
+				t.Fatalf("Expected recorded %t, but got %t", tt.wantEvent, got)
+			}
+			if tt.wantEvent && (len(sink.events[0].Groups) > 0) != tt.wantGroups {
+				t.Errorf("Unexpected groups %v at level %s", sink.events[0].Groups, tt.level)
+			}
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	DefaultAuditor = NewAuditor(DefaultPolicy(), testKey, NewWriterSink(&buf))
+	defer func() { DefaultAuditor = nil }()
+
+	r := httptest.NewRequest("GET", "/v2/ns/repo/manifests/latest", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	info := &utils.RequestInfo{Subject: "user1", Repository: "ns/repo", Namespace: "repo", Decision: utils.DecisionDeny, Reason: "permission_denied"}
+	Record(EventAuthorization, r, info)
+
+	var e Event
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if e.Subject != "user1" || e.Repository != "ns/repo" || e.Decision != utils.DecisionDeny || e.ClientIP != "10.0.0.1" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
+
+// droppingSink fails to write the events at the given write indexes with err
+type droppingSink struct {
+	memorySink
+	writes int
+	drop   map[int]bool
+	err    error
+}
+
+func (s *droppingSink) Write(e Event) error {
+	s.writes++
+	if s.drop[s.writes] {
+		return s.err
+	}
+	return s.memorySink.Write(e)
+}
+
+func TestAuditorChainGap(t *testing.T) {
+	sink := &droppingSink{drop: map[int]bool{2: true, 3: true}, err: ErrQueueFull}
+	complete := &memorySink{}
+	auditor := NewAuditor(DefaultPolicy(), testKey, sink, complete)
+	for range 4 {
+		auditor.Record(Event{Type: EventAuthorization, Subject: "user1", Decision: utils.DecisionAllow})
+	}
+
+	if len(sink.events) != 3 || sink.events[1].Type != EventChainGap || sink.events[1].Dropped != 2 {
+		t.Fatalf("Expected a chain gap event for 2 dropped events, but got %+v", sink.events)
+	}
+	dropped, err := VerifyChain(sink.events, testKey, "")
+	if err != nil {
+		t.Errorf("Unexpected chain error %s", err)
+	}
+	if dropped != 2 {
+		t.Errorf("Expected 2 dropped events, but got %d", dropped)
+	}
+	if dropped, err := VerifyChain(complete.events, testKey, ""); err != nil || dropped != 0 {
+		t.Errorf("Expected the other sink to have the complete chain, but got %d dropped and %v", dropped, err)
+	}
+
+	// Removing the gap event, or forging it without the key, is detected as tampering
+	if _, err := VerifyChain([]Event{sink.events[0], sink.events[2]}, testKey, ""); err == nil {
+		t.Error("Expected removed gap event to break the chain")
+	}
+	forged := append([]Event{}, sink.events...)
+	forged[1].Dropped = 1
+	if _, err := VerifyChain(forged, testKey, ""); err == nil {
+		t.Error("Expected modified gap event to break the chain")
+	}
+}
+
+func TestAuditorChainGapSinkError(t *testing.T) {
+	// Events a sink failed to write for any reason are recorded as a gap, not reported as tampering
+	sink := &droppingSink{drop: map[int]bool{2: true}, err: errors.New("no space left on device")}
+	auditor := NewAuditor(DefaultPolicy(), testKey, sink)
+	for range 3 {
+		auditor.Record(Event{Type: EventAuthorization, Subject: "user1", Decision: utils.DecisionAllow})
+	}
+
+	if len(sink.events) != 3 || sink.events[1].Type != EventChainGap || sink.events[1].Dropped != 1 {
+		t.Fatalf("Expected a chain gap event for 1 dropped event, but got %+v", sink.events)
+	}
+	if dropped, err := VerifyChain(sink.events, testKey, ""); err != nil || dropped != 1 {
+		t.Errorf("Expected 1 dropped event, but got %d and %v", dropped, err)
+	}
+}
@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+- level: None
+  users: ["system:serviceaccount:ci:robot"]
+- level: Request
+  decisions: ["deny"]
+- level: Metadata
+  types: ["authorization"]
+  namespaces: ["team-a"]
+`
+
+func TestLevelFor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	levelTests := []struct {
+		name  string
+		event Event
+		level Level
+	}{
+		{"Ignored user", Event{Subject: "system:serviceaccount:ci:robot", Decision: "deny"}, LevelNone},
+		{"Denied request", Event{Subject: "user1", Decision: "deny"}, LevelRequest},
+		{"Allowed in namespace", Event{Type: EventAuthorization, Namespace: "team-a", Decision: "allow"}, LevelMetadata},
+		{"No matching rule", Event{Type: EventAuthorization, Namespace: "team-b", Decision: "allow"}, LevelNone},
+	}
+
+	for _, tt := range levelTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.LevelFor(tt.event); got != tt.level {
+				t.Errorf("Expected level %s, but got %s", tt.level, got)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyInvalidLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("rules:\n- level: Everything\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy(path); err == nil {
+		t.Error("Expected error for invalid level")
+	}
+}
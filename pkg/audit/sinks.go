@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+// WriterSink writes events as JSON lines to a writer
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink constructs a WriterSink
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write encodes the event on its own line
+func (s *WriterSink) Write(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(s.w).Encode(e)
+}
+
+// Close is a no-op for writers owned by the caller
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes events as JSON lines to a file, rotating it once it reaches a maximum size
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens the file at path for appending.
+// The file is rotated to path.1, path.2, ... once it exceeds maxSizeMB, keeping maxBackups old files.
+func NewFileSink(path string, maxSizeMB, maxBackups int) (*FileSink, error) {
+	if path == "" {
+		return nil, errors.New("audit file path is not specified")
+	}
+	s := &FileSink{path: path, maxSize: int64(maxSizeMB) << 20, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600) // #nosec G304 -- audit path comes from trusted configuration
+	if err != nil {
+		return fmt.Errorf("unable to open audit file: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat audit file: %s", err)
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+// Write appends the event, rotating the file first if needed
+func (s *FileSink) Write(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to marshal audit event: %s", err)
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("unable to close audit file: %s", err)
+	}
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("unable to rotate audit file: %s", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("unable to rotate audit file: %s", err)
+	}
+	return s.open()
+}
+
+// Close closes the underlying file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// webhookBatchSize is the maximum number of events sent in one webhook request
+const webhookBatchSize = 100
+
+// WebhookSink posts batches of events to an HTTP endpoint from a background worker
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	events chan Event
+	done   chan struct{}
+}
+
+// webhookPayload is the body posted to the webhook
+type webhookPayload struct {
+	Events []Event `json:"events"`
+}
+
+// NewWebhookSink starts a worker posting events to url
+func NewWebhookSink(url string) (*WebhookSink, error) {
+	if url == "" {
+		return nil, errors.New("audit webhook url is not specified")
+	}
+	s := &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan Event, 10*webhookBatchSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// ErrQueueFull is returned by sinks that dropped an event because they could not keep up
+var ErrQueueFull = errors.New("audit webhook queue is full, dropping event")
+
+// Write queues the event, dropping it if the queue is full so requests are never blocked
+func (s *WebhookSink) Write(e Event) error {
+	select {
+	case s.events <- e:
+		return nil
+	default:
+		metrics.AuditEventsDropped.WithLabelValues("webhook").Inc()
+		return ErrQueueFull
+	}
+}
+
+// Close flushes queued events and stops the worker
+func (s *WebhookSink) Close() error {
+	close(s.events)
+	<-s.done
+	return nil
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, webhookBatchSize)
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == webhookBatchSize {
+				s.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *WebhookSink) send(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{Events: batch})
+	if err != nil {
+		logrus.Errorf("Unable to marshal audit events: %s", err)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body)) // #nosec G107 -- webhook url comes from trusted configuration
+	if err != nil {
+		logrus.Errorf("Unable to send %d audit events: %s", len(batch), err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		logrus.Errorf("Audit webhook rejected %d events with status %d", len(batch), resp.StatusCode)
+	}
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 0, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	// Use a tiny size so every event rotates the file
+	sink.maxSize = 10
+	for i := 0; i < 4; i++ {
+		if err := sink.Write(Event{Type: EventAuthorization}); err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to exist: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan []Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload.Events
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	_ = sink.Write(Event{ID: "1"})
+	_ = sink.Write(Event{ID: "2"})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	events := <-received
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events, but got %d", len(events))
+	}
+}
+
+func TestWebhookSinkQueueFull(t *testing.T) {
+	sink := &WebhookSink{events: make(chan Event)}
+	before := testutil.ToFloat64(metrics.AuditEventsDropped.WithLabelValues("webhook"))
+	if err := sink.Write(Event{ID: "1"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, but got %v", err)
+	}
+	if n := testutil.ToFloat64(metrics.AuditEventsDropped.WithLabelValues("webhook")) - before; n != 1 {
+		t.Errorf("Expected 1 dropped event to be counted, but got %v", n)
+	}
+}
+
+func TestInitFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "audit.key")
+	if err := os.WriteFile(keyFile, testKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	shortKeyFile := filepath.Join(dir, "short.key")
+	if err := os.WriteFile(shortKeyFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	initTests := []struct {
+		name    string
+		sinks   string
+		keyFile string
+		wantErr string
+	}{
+		{"Unsupported sink", "stdout,unknown", keyFile, "unsupported audit sink"},
+		{"Missing key", "stdout", "", "key file is not specified"},
+		{"Short key", "stdout", shortKeyFile, "at least"},
+		{"Valid config", "file", keyFile, ""},
+	}
+
+	for _, tt := range initTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUDIT_SINKS", tt.sinks)
+			t.Setenv("AUDIT_HMAC_KEY_FILE", tt.keyFile)
+			t.Setenv("AUDIT_FILE_PATH", filepath.Join(dir, "audit.log"))
+			defer func() { DefaultAuditor = nil }()
+
+			err := InitFromEnv()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error %s", err)
+				}
+				_ = DefaultAuditor.Close()
+				if _, err := os.Stat(filepath.Join(dir, "audit.log.head")); err != nil {
+					t.Errorf("Expected the chain head to be persisted next to the audit file: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error %q, but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
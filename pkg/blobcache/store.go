@@ -0,0 +1,242 @@
+package blobcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// digestPattern matches the sha256 digests the store accepts
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ValidDigest reports whether a digest can be stored
+func ValidDigest(digest string) bool {
+	return digestPattern.MatchString(digest)
+}
+
+type entry struct {
+	digest string
+	size   int64
+}
+
+// Store is a content-addressed blob store on local disk evicting least recently used blobs above a size cap.
+// Blobs are only written once their content matches their sha256 digest.
+type Store struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	// repos records the repositories each blob was verified to belong to upstream
+	repos map[string]map[string]struct{}
+}
+
+// NewStore opens the store in dir, indexing blobs left by a previous run
+func NewStore(dir string, maxSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create blob cache directory: %s", err)
+	}
+	s := &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		repos:   map[string]map[string]struct{}{},
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob cache directory: %s", err)
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if !ValidDigest("sha256:" + f.Name()) {
+			// Remove partial writes of a previous run
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		s.add("sha256:"+info.Name(), info.Size())
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// NewStoreFromEnv opens the store in BLOB_CACHE_DIR capped at BLOB_CACHE_MAX_SIZE_MB.
+// It returns nil when the blob cache is not configured.
+func NewStoreFromEnv() (*Store, error) {
+	dir := os.Getenv("BLOB_CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	return NewStore(dir, int64(utils.EnvInt("BLOB_CACHE_MAX_SIZE_MB", 10240))<<20)
+}
+
+func (s *Store) path(digest string) string {
+	return filepath.Join(s.dir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+// add indexes a blob as most recently used
+func (s *Store) add(digest string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[digest]; ok {
+		return
+	}
+	s.entries[digest] = s.lru.PushFront(&entry{digest: digest, size: size})
+	s.size += size
+	metrics.BlobCacheSize.Set(float64(s.size))
+}
+
+// evict removes least recently used blobs until the store fits its cap. Callers must hold s.mu.
+func (s *Store) evict() {
+	for s.size > s.maxSize {
+		el := s.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*entry)
+		s.lru.Remove(el)
+		delete(s.entries, e.digest)
+		delete(s.repos, e.digest)
+		s.size -= e.size
+		// Open readers keep streaming from the unlinked file
+		if err := os.Remove(s.path(e.digest)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("Unable to evict blob %s: %s", e.digest, err)
+		}
+		metrics.BlobCacheEvictions.Inc()
+	}
+	metrics.BlobCacheSize.Set(float64(s.size))
+}
+
+// Open returns the stored blob, marking it as recently used
+func (s *Store) Open(digest string) (*os.File, bool) {
+	s.mu.Lock()
+	el, ok := s.entries[digest]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(s.path(digest))
+	if err != nil {
+		logrus.Errorf("Unable to open cached blob %s: %s", digest, err)
+		return nil, false
+	}
+	return f, true
+}
+
+// Linked reports whether a blob was verified to belong to a repository
+func (s *Store) Linked(repo, digest string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.repos[digest][repo]
+	return ok
+}
+
+// Link records that a stored blob belongs to a repository upstream
+func (s *Store) Link(repo, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[digest]; !ok {
+		return
+	}
+	if s.repos[digest] == nil {
+		s.repos[digest] = map[string]struct{}{}
+	}
+	s.repos[digest][repo] = struct{}{}
+}
+
+// Writer stores a blob once its content is verified against its digest
+type Writer struct {
+	store  *Store
+	digest string
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	err    error
+}
+
+// Create starts writing a blob to a temporary file
+func (s *Store) Create(digest string) (*Writer, error) {
+	if !ValidDigest(digest) {
+		return nil, fmt.Errorf("unsupported digest %s", digest)
+	}
+	f, err := os.CreateTemp(s.dir, "blob-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cached blob: %s", err)
+	}
+	return &Writer{store: s, digest: digest, file: f, hash: sha256.New()}, nil
+}
+
+// Write appends to the blob. Once a write fails or the blob exceeds the store's cap, further writes are ignored.
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return len(b), nil
+	}
+	w.size += int64(len(b))
+	if w.size > w.store.maxSize {
+		w.err = errors.New("blob exceeds the cache size")
+		return len(b), nil
+	}
+	w.hash.Write(b)
+	if _, err := w.file.Write(b); err != nil {
+		w.err = err
+	}
+	return len(b), nil
+}
+
+// Commit verifies the digest and moves the blob into the store
+func (w *Writer) Commit() error {
+	defer func() { _ = os.Remove(w.file.Name()) }()
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return fmt.Errorf("unable to write cached blob %s: %s", w.digest, w.err)
+	}
+	if sum := "sha256:" + hex.EncodeToString(w.hash.Sum(nil)); sum != w.digest {
+		return fmt.Errorf("blob content %s does not match digest %s", sum, w.digest)
+	}
+	if err := os.Rename(w.file.Name(), w.store.path(w.digest)); err != nil {
+		return fmt.Errorf("unable to store cached blob %s: %s", w.digest, err)
+	}
+
+	w.store.add(w.digest, w.size)
+	w.store.mu.Lock()
+	w.store.evict()
+	w.store.mu.Unlock()
+	return nil
+}
+
+// Abort discards the blob
+func (w *Writer) Abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
@@ -0,0 +1,125 @@
+package blobcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+)
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func put(t *testing.T, s *Store, digest, content string) error {
+	t.Helper()
+	w, err := s.Create(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(content))
+	return w.Commit()
+}
+
+func TestStore(t *testing.T) {
+	s, err := NewStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, c := digestOf("aaaa"), digestOf("bbbb"), digestOf("cccc")
+	if err := put(t, s, a, "aaaa"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	f, ok := s.Open(a)
+	if !ok {
+		t.Fatal("Expected stored blob")
+	}
+	content, _ := io.ReadAll(f)
+	_ = f.Close()
+	if string(content) != "aaaa" {
+		t.Errorf("Expected stored content, got %q", content)
+	}
+
+	// Content not matching the digest is rejected
+	if err := put(t, s, b, "tampered"); err == nil {
+		t.Error("Expected digest mismatch error")
+	}
+	if _, ok := s.Open(b); ok {
+		t.Error("Expected rejected blob not to be stored")
+	}
+
+	// Blobs larger than the cap are not stored
+	if err := put(t, s, digestOf("too large blob"), "too large blob"); err == nil {
+		t.Error("Expected error for blob exceeding the cap")
+	}
+
+	// The least recently used blob is evicted
+	if err := put(t, s, b, "bbbb"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	s.Link("repo", b)
+	if f, ok := s.Open(a); ok {
+		_ = f.Close()
+	}
+	if err := put(t, s, c, "cccc"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if _, ok := s.Open(b); ok {
+		t.Error("Expected least recently used blob to be evicted")
+	}
+	if s.Linked("repo", b) {
+		t.Error("Expected links of evicted blob to be dropped")
+	}
+	if _, ok := s.Open(a); !ok {
+		t.Error("Expected recently used blob to be kept")
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := digestOf("aaaa")
+	if err := put(t, s, a, "aaaa"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	s.Link("repo", a)
+	partial, _ := os.CreateTemp(dir, "blob-*.tmp")
+	_ = partial.Close()
+
+	s, err = NewStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Open(a); !ok {
+		t.Error("Expected blob from previous run to be indexed")
+	}
+	if s.Linked("repo", a) {
+		t.Error("Expected links to be verified again after a restart")
+	}
+	if _, err := os.Stat(partial.Name()); !os.IsNotExist(err) {
+		t.Error("Expected partial write to be removed")
+	}
+}
+
+func TestValidDigest(t *testing.T) {
+	validTests := []struct {
+		digest string
+		valid  bool
+	}{
+		{digestOf("a"), true},
+		{"sha256:abc", false},
+		{"sha512:" + digestOf("a")[7:], false},
+		{"sha256:../../etc/passwd", false},
+	}
+	for _, tt := range validTests {
+		if got := ValidDigest(tt.digest); got != tt.valid {
+			t.Errorf("ValidDigest(%q) = %t, expected %t", tt.digest, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+// acrRefreshTokenUser is the username ACR expects with a refresh token as the password
+const acrRefreshTokenUser = "00000000-0000-0000-0000-000000000000"
+
+// acrScope is the AAD scope of tokens accepted by the ACR exchange endpoint
+const acrScope = "https://containerregistry.azure.net/.default"
+
+type aadTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+type acrExchangeResponse struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newACRCredentials returns a provider exchanging an AAD access token for an ACR refresh token.
+// The AAD application is read from AZURE_TENANT_ID and AZURE_CLIENT_ID, authenticating with AZURE_CLIENT_SECRET or the workload identity token at AZURE_FEDERATED_TOKEN_FILE.
+// The AAD authority is the configured endpoint, AZURE_AUTHORITY_HOST or login.microsoftonline.com.
+func newACRCredentials(cfg AuthConfig, registryURL string) (cloudCredentials, error) {
+	tenant, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	if tenant == "" || clientID == "" {
+		return nil, errors.New("AZURE_TENANT_ID and AZURE_CLIENT_ID are not specified")
+	}
+	secret, tokenFile := os.Getenv("AZURE_CLIENT_SECRET"), os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if secret == "" && tokenFile == "" {
+		return nil, errors.New("AZURE_CLIENT_SECRET or AZURE_FEDERATED_TOKEN_FILE is not specified")
+	}
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable parse registry url: %s", err)
+	}
+	authority := strings.TrimSuffix(firstNonEmpty(cfg.Endpoint, os.Getenv("AZURE_AUTHORITY_HOST"), "https://login.microsoftonline.com"), "/")
+	client := newCloudClient()
+
+	return func(ctx context.Context) (*registryCredentials, time.Time, error) {
+		values := url.Values{}
+		values.Set("grant_type", "client_credentials")
+		values.Set("client_id", clientID)
+		values.Set("scope", acrScope)
+		if tokenFile != "" {
+			// The workload identity token is rotated by the kubelet, so read it on every exchange
+			assertion, err := os.ReadFile(tokenFile) // #nosec G304 -- token path comes from trusted configuration
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("unable to read federated token: %s", err)
+			}
+			values.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+			values.Set("client_assertion", strings.TrimSpace(string(assertion)))
+		} else {
+			values.Set("client_secret", secret)
+		}
+		var aad aadTokenResponse
+		if err := postForm(ctx, client, authority+"/"+tenant+"/oauth2/v2.0/token", values, &aad); err != nil {
+			return nil, time.Time{}, err
+		}
+
+		exchange := url.Values{}
+		exchange.Set("grant_type", "access_token")
+		exchange.Set("service", u.Host)
+		exchange.Set("tenant", tenant)
+		exchange.Set("access_token", aad.AccessToken)
+		var acr acrExchangeResponse
+		if err := postForm(ctx, client, strings.TrimSuffix(registryURL, "/")+"/oauth2/exchange", exchange, &acr); err != nil {
+			return nil, time.Time{}, err
+		}
+		if acr.RefreshToken == "" {
+			return nil, time.Time{}, errors.New("no refresh token received from ACR")
+		}
+
+		expires := time.Now().Add(time.Hour)
+		if claims := utils.TokenClaims(acr.RefreshToken); claims != nil && claims.ExpiresAt > 0 {
+			expires = time.Unix(claims.ExpiresAt, 0)
+		}
+		return &registryCredentials{Username: acrRefreshTokenUser, Password: acr.RefreshToken}, expires, nil
+	}, nil
+}
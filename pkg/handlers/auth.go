@@ -5,38 +5,58 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
+	"image-rbac-proxy/pkg/apikeys"
+	"image-rbac-proxy/pkg/audit"
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
 // AuthHandler issues auth token for podman
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
+	info := utils.RequestInfoFrom(r.Context())
+
 	// Use the password as the token
 	_, token, ok := r.BasicAuth()
 	if !ok {
+		info.Decision, info.Reason = utils.DecisionDeny, "missing_credentials"
+		audit.Record(audit.EventTokenRequest, r, info)
 		utils.ErrorHTTPResponse(w, utils.Unauthorized, "No basic auth credentials provided")
 		return
 	}
 
 	username := ""
 	claims := utils.TokenClaims(token)
-	if claims != nil {
+	if apikeys.IsAPIKey(token) {
+		// Verify API key managed by the proxy
+		if key, err := apikeys.DefaultStore.Verify(token); err == nil {
+			username, info.Groups = key.User, key.Groups
+		}
+		info.Issuer = utils.IssuerAPIKey
+	} else if claims != nil {
 		if claims.Issuer == os.Getenv("DEX_URL") {
 			// Verify user's token issued by dex
-			username, _ = VerifyIDToken(token)
+			username, info.Groups = VerifyIDToken(r.Context(), token)
+			info.Issuer = utils.IssuerDex
 		} else {
 			// Verify serive account's token issued by OpenShift
-			username = VerifyServiceAccount(token)
+			username = VerifyServiceAccount(r.Context(), token)
+			info.Issuer = utils.IssuerServiceAccount
 		}
 	}
 	if username != "" {
-		logrus.Printf("Verified user: %s", username)
+		info.Subject = username
+		info.Decision, info.Reason = utils.DecisionAllow, "token_verified"
+		audit.Record(audit.EventTokenRequest, r, info)
 		data := map[string]string{
 			"token": token,
 		}
@@ -45,11 +65,16 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 			logrus.Errorf("Error encoding auth response: %s", err)
 		}
 	} else {
+		info.Decision, info.Reason = utils.DecisionDeny, "invalid_token"
+		audit.Record(audit.EventTokenRequest, r, info)
 		utils.ErrorHTTPResponse(w, utils.Unauthorized, "Token is invalid or expired")
 	}
 }
 
-func VerifyServiceAccount(token string) string {
+func VerifyServiceAccount(ctx context.Context, token string) string {
+	ctx, span := tracing.Start(ctx, "VerifyServiceAccount")
+	defer span.End()
+
 	config := &rest.Config{
 		Host:        os.Getenv("CLUSTER_URL"),
 		BearerToken: os.Getenv("OAUTH_TOKEN"),
@@ -58,6 +83,7 @@ func VerifyServiceAccount(token string) string {
 	// Create a Kubernetes client
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
+		tracing.RecordError(span, err)
 		logrus.Errorf("Error creating Kubernetes client: %s", err)
 		return ""
 	}
@@ -68,19 +94,26 @@ func VerifyServiceAccount(token string) string {
 			Token: token,
 		},
 	}
-	response, err := client.AuthenticationV1().TokenReviews().Create(context.Background(), tr, metav1.CreateOptions{})
+	start := time.Now()
+	response, err := client.AuthenticationV1().TokenReviews().Create(ctx, tr, metav1.CreateOptions{})
+	metrics.TokenReviewDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		metrics.TokenReviews.WithLabelValues("error").Inc()
+		tracing.RecordError(span, err)
 		logrus.Errorf("Token review failed with error: %s", err)
 		return ""
 	}
 
 	if !response.Status.Authenticated {
+		metrics.TokenReviews.WithLabelValues("unauthenticated").Inc()
 		if response.Status.Error != "" {
 			logrus.Errorf("Token is not authenticated: %s", response.Status.Error)
 		}
 		return ""
 	}
 
+	metrics.TokenReviews.WithLabelValues("authenticated").Inc()
+	span.SetAttributes(attribute.String("user", response.Status.User.Username))
 	return response.Status.User.Username
 }
@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"image-rbac-proxy/pkg/apikeys"
 	"image-rbac-proxy/pkg/tests"
 )
 
@@ -34,8 +38,8 @@ func TestAuthHandlerServiceAccount(t *testing.T) {
 			name: "Successful authentication",
 			openshiftResponse: []tests.Response{
 				{
-					200,
-					tests.TrResponse(true, "user1"),
+					Code: 200,
+					Body: tests.TrResponse(true, "user1"),
 				},
 			},
 			wantAuthenticated: true,
@@ -44,8 +48,8 @@ func TestAuthHandlerServiceAccount(t *testing.T) {
 			name: "TokenReview call failure",
 			openshiftResponse: []tests.Response{
 				{
-					500,
-					"Internal server error",
+					Code: 500,
+					Body: "Internal server error",
 				},
 			},
 			wantAuthenticated: false,
@@ -94,3 +98,37 @@ func TestAuthHandlerUser(t *testing.T) {
 		t.Errorf("Expected auth %d, but got %d", http.StatusOK, rr.Code)
 	}
 }
+
+func TestAuthHandlerAPIKey(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	sum := sha256.Sum256([]byte(secret))
+	apikeys.DefaultStore = apikeys.New(map[string]*apikeys.Key{
+		"ci-bot": {ID: "ci-bot", Hash: hex.EncodeToString(sum[:]), User: "ci-bot"},
+	})
+	defer func() { apikeys.DefaultStore = nil }()
+
+	keyTests := []struct {
+		name              string
+		password          string
+		wantAuthenticated bool
+	}{
+		{"Valid API key", "irp_ci-bot_" + secret, true},
+		{"Unknown API key", "irp_ci-bot_" + strings.Repeat("0", 32), false},
+	}
+
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth", nil)
+			r.SetBasicAuth("ci-bot", tt.password)
+			rr := httptest.NewRecorder()
+			AuthHandler(rr, r)
+
+			if tt.wantAuthenticated && rr.Code != http.StatusOK {
+				t.Errorf("Expected auth %d, but got %d", http.StatusOK, rr.Code)
+			}
+			if !tt.wantAuthenticated && rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected auth %d, but got %d", http.StatusUnauthorized, rr.Code)
+			}
+		})
+	}
+}
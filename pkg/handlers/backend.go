@@ -1,27 +1,82 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
 var BackendRegistry *BackendProxy
 
-// BackendProxy is a ReverseProxy pointer for the backend registry
+// BackendProxy is a ReverseProxy pointer for the backend registry.
+// It is constructed by NewBackendProxy and must not be modified afterwards.
 type BackendProxy struct {
 	URL   string
 	Proxy *httputil.ReverseProxy
 	Auth  BackendAuth
+	// Redirects is RedirectPassthrough (the default) or RedirectFollow
+	Redirects string
+	target    *url.URL
+	breaker   *circuitBreaker
+	// transport sends requests to this upstream only
+	transport http.RoundTripper
+	// mirrors are tried in order when this upstream fails
+	mirrors []*BackendProxy
+}
+
+// NewBackendProxy validates the backend configuration and sets up the reverse proxy.
+// Requests fail over to the mirrors in order when the upstream is unavailable or does not know a manifest.
+func NewBackendProxy(rawURL string, auth BackendAuth, redirects string, mirrors ...*BackendProxy) (*BackendProxy, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse backend url: %s", err)
+	}
+	if (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return nil, fmt.Errorf("backend url %q must be an absolute http or https url", rawURL)
+	}
+	if auth == nil {
+		return nil, errors.New("backend auth is not specified")
+	}
+	switch redirects {
+	case "", RedirectPassthrough, RedirectFollow:
+	default:
+		return nil, fmt.Errorf("unsupported redirect mode %q", redirects)
+	}
+
+	bp := &BackendProxy{URL: rawURL, Auth: auth, Redirects: redirects, target: target, mirrors: mirrors}
+	// The breaker opens after BACKEND_BREAKER_FAILURES consecutive failures, 0 disables it
+	if threshold := utils.EnvInt("BACKEND_BREAKER_FAILURES", 5); threshold > 0 {
+		state := metrics.BackendCircuitState.WithLabelValues(rawURL)
+		state.Set(breakerClosed)
+		bp.breaker = newCircuitBreaker(threshold, utils.EnvDuration("BACKEND_BREAKER_COOLDOWN", 30*time.Second), func(s int) {
+			state.Set(float64(s))
+			if s == breakerOpen {
+				logrus.Warnf("Circuit breaker for registry backend with URL %s is open", rawURL)
+			}
+		})
+	}
+	bp.Proxy = bp.newReverseProxy()
+	return bp, nil
 }
 
 // BackendAuth provides methods to authenticate to a backend registry
 type BackendAuth interface {
-	AuthorizationHeader(*BackendProxy, string) (string, error)
+	AuthorizationHeader(context.Context, *BackendProxy, string) (string, error)
+}
+
+// challengeCache is implemented by BackendAuth types that cache the registry's auth challenge
+type challengeCache interface {
+	InvalidateChallenge()
 }
 
 // RegistryHandler is the handler that enforces authentication
@@ -31,36 +86,79 @@ func RegistryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	bp := BackendRegistry
+	if !bp.Ready() {
+		w.Header().Set("Retry-After", "5")
+		utils.ErrorHTTPResponse(w, utils.Unavailable, "Backend registry is unavailable")
+		return
+	}
+	if len(bp.mirrors) > 0 {
+		// Credentials of each upstream in the group are added by the failover transport
+		r.Header.Del("Authorization")
+		bp.ProxyHandler(w, r)
+		return
+	}
 	repoName := utils.RepoFromPath(r.URL.Path)
 
-	header, err := bp.Auth.AuthorizationHeader(bp, repoName)
+	header, err := bp.Auth.AuthorizationHeader(r.Context(), bp, repoName)
 	if err != nil {
 		logrus.Errorf("Unable to fetch credentials for registry backend: %s", err)
 		utils.ErrorHTTPResponse(w, utils.Unavailable, "Server error encountered while fetching credentials")
 		return
 	}
-	r.Header.Set("Authorization", header)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	} else {
+		// Never forward the client's own credentials upstream
+		r.Header.Del("Authorization")
+	}
 
 	bp.ProxyHandler(w, r)
 }
 
-// ProxyHandler simply proxies the request to the backend
-func (bp *BackendProxy) ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	if bp.Proxy == nil {
-		bp.Initialize(r)
+// Ready reports whether the backend or any of its mirrors is accepting requests.
+// An upstream does not accept requests while its circuit breaker is open.
+func (bp *BackendProxy) Ready() bool {
+	if bp.breaker == nil || !bp.breaker.open() {
+		return true
 	}
+	for _, m := range bp.mirrors {
+		if m.Ready() {
+			return true
+		}
+	}
+	return false
+}
 
-	bp.Proxy.ServeHTTP(w, r)
+// ProxyHandler simply proxies the request to the backend
+func (bp *BackendProxy) ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	rec := utils.NewStatusRecorder(w)
+	bp.Proxy.ServeHTTP(rec, r)
+	metrics.ProxiedBytes.Add(float64(rec.Bytes))
 }
 
-// Initialize sets up the transport and client for the reverse proxy
-func (bp *BackendProxy) Initialize(r *http.Request) {
-	// create the reverse proxy
-	bp.Proxy = &httputil.ReverseProxy{
+// newReverseProxy sets up the transport and client for the reverse proxy
+func (bp *BackendProxy) newReverseProxy() *httputil.ReverseProxy {
+	base := tracing.Transport(utils.Transport)
+	upstream := &retryTransport{base: base, policy: retryPolicyFromEnv(), breaker: bp.breaker}
+	bp.transport = &tokenRefreshTransport{bp: bp, base: upstream}
+	if bp.Redirects == RedirectFollow {
+		bp.transport = &redirectTransport{registry: bp.transport, storage: base}
+	}
+	transport := bp.transport
+	if len(bp.mirrors) > 0 {
+		transport = &failoverTransport{upstreams: append([]*BackendProxy{bp}, bp.mirrors...)}
+	}
+
+	return &httputil.ReverseProxy{
+		Transport: transport,
 		Director: func(req *http.Request) {
-			req.URL.Host = bp.GetURL().Host
-			req.URL.Scheme = bp.GetURL().Scheme
-			req.Host = bp.GetURL().Host
+			req.URL.Host = bp.target.Host
+			req.URL.Scheme = bp.target.Scheme
+			req.Host = bp.target.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			utils.RequestInfoFrom(resp.Request.Context()).UpstreamStatus = resp.StatusCode
+			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			logrus.WithError(err).Error("Backend request failed")
@@ -68,9 +166,3 @@ func (bp *BackendProxy) Initialize(r *http.Request) {
 		},
 	}
 }
-
-// GetURL returns a URL from the configured string
-func (bp *BackendProxy) GetURL() *url.URL {
-	u, _ := url.Parse(bp.URL)
-	return u
-}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Backend auth types selectable in AuthConfig
+const (
+	AuthTypeToken        = "token"
+	AuthTypeAnonymous    = "anonymous"
+	AuthTypeBearer       = "bearer"
+	AuthTypeBasic        = "basic"
+	AuthTypeDockerConfig = "dockerconfig"
+	AuthTypeECR          = "ecr"
+	AuthTypeGCP          = "gcp"
+	AuthTypeACR          = "acr"
+)
+
+// AuthConfig selects and configures the BackendAuth of a backend.
+// Credentials read from files or a secret are reloaded when they change.
+type AuthConfig struct {
+	// Type is one of token (the default), anonymous, bearer, basic, dockerconfig, ecr, gcp or acr
+	Type     string `json:"type,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Token is the static token sent by the bearer type
+	Token string `json:"token,omitempty"`
+	// UsernameFile, PasswordFile and TokenFile are files such as mounted secret keys overriding the inline values
+	UsernameFile string `json:"usernameFile,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+	// CredentialsSecret is a secret in the form namespace/name with username, password or token keys overriding the inline values
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+	// DockerConfigPath is a dockerconfigjson or auth.json file read by the dockerconfig type
+	DockerConfigPath string `json:"dockerConfigPath,omitempty"`
+	// DockerConfigSecret is a dockerconfigjson secret in the form namespace/name read by the dockerconfig type
+	DockerConfigSecret string `json:"dockerConfigSecret,omitempty"`
+	// Endpoint overrides the credential exchange endpoint of the ecr, gcp and acr types
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// NewBackendAuth constructs the BackendAuth selected by the config for the registry at registryURL.
+// Credentials from files or secrets are watched for changes until ctx is done.
+func NewBackendAuth(ctx context.Context, cfg AuthConfig, registryURL string) (BackendAuth, error) {
+	switch cfg.Type {
+	case "", AuthTypeToken, AuthTypeBearer, AuthTypeBasic, AuthTypeDockerConfig:
+	case AuthTypeAnonymous:
+		return NewAnonymousAuth(), nil
+	case AuthTypeECR:
+		provider, err := newECRCredentials(cfg, registryURL)
+		if err != nil {
+			return nil, err
+		}
+		// ECR accepts its authorization token as basic credentials
+		return newCloudAuth(AuthTypeBasic, provider), nil
+	case AuthTypeGCP:
+		provider, err := newGCPCredentials(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newCloudAuth(AuthTypeToken, provider), nil
+	case AuthTypeACR:
+		provider, err := newACRCredentials(cfg, registryURL)
+		if err != nil {
+			return nil, err
+		}
+		return newCloudAuth(AuthTypeToken, provider), nil
+	default:
+		return nil, fmt.Errorf("unsupported backend auth type %q", cfg.Type)
+	}
+
+	creds, err := loadCredentials(ctx, cfg, registryURL)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := authFromCredentials(cfg.Type, creds)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.rotatable() {
+		go watchCredentials(ctx, cfg, registryURL, auth, creds)
+	}
+	return auth, nil
+}
+
+// authFromCredentials constructs the BackendAuth of an auth type from loaded credentials
+func authFromCredentials(authType string, creds *registryCredentials) (BackendAuth, error) {
+	switch authType {
+	case AuthTypeBearer:
+		if creds.RegistryToken == "" {
+			return nil, errors.New("token is not specified for bearer auth")
+		}
+		return NewBearerAuth(creds.RegistryToken), nil
+	case AuthTypeBasic:
+		if creds.Username == "" || creds.Password == "" {
+			return nil, errors.New("username and password are not specified for basic auth")
+		}
+		return NewBasicAuth(creds.Username, creds.Password), nil
+	case AuthTypeDockerConfig:
+		if creds.RegistryToken != "" {
+			return NewBearerAuth(creds.RegistryToken), nil
+		}
+		// Credentials are exchanged for tokens like the token type
+		return NewTokenAuth(creds.Username, creds.Password), nil
+	default:
+		return NewTokenAuth(creds.Username, creds.Password), nil
+	}
+}
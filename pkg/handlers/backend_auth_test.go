@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewBackendAuth(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:secret"))
+	config := `{"auths":{"https://quay.io/v1/":{"auth":"` + auth + `"},"ghcr.io":{"registrytoken":"ghtoken"}}}`
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         AuthConfig
+		registryURL string
+		header      string
+		tokenUser   string
+		err         string
+	}{
+		{name: "default", cfg: AuthConfig{Username: "u", Password: "p"}, tokenUser: "u"},
+		{name: "anonymous", cfg: AuthConfig{Type: AuthTypeAnonymous}},
+		{name: "bearer", cfg: AuthConfig{Type: AuthTypeBearer, Token: "abc"}, header: "Bearer abc"},
+		{name: "bearer without token", cfg: AuthConfig{Type: AuthTypeBearer}, err: "token is not specified"},
+		{name: "basic", cfg: AuthConfig{Type: AuthTypeBasic, Username: "u", Password: "p"}, header: "Basic dTpw"},
+		{name: "basic without password", cfg: AuthConfig{Type: AuthTypeBasic, Username: "u"}, err: "username and password"},
+		{name: "dockerconfig auth", cfg: AuthConfig{Type: AuthTypeDockerConfig, DockerConfigPath: configPath}, registryURL: "https://quay.io", tokenUser: "robot"},
+		{name: "dockerconfig registry token", cfg: AuthConfig{Type: AuthTypeDockerConfig, DockerConfigPath: configPath}, registryURL: "https://ghcr.io", header: "Bearer ghtoken"},
+		{name: "dockerconfig missing registry", cfg: AuthConfig{Type: AuthTypeDockerConfig, DockerConfigPath: configPath}, registryURL: "https://docker.io", err: "no credentials for docker.io"},
+		{name: "dockerconfig missing source", cfg: AuthConfig{Type: AuthTypeDockerConfig}, err: "path or secret is not specified"},
+		{name: "unsupported", cfg: AuthConfig{Type: "kerberos"}, err: "unsupported backend auth type"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			auth, err := NewBackendAuth(t.Context(), tc.cfg, tc.registryURL)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			switch a := auth.(type) {
+			case *StaticAuth:
+				if *a.header.Load() != tc.header {
+					t.Errorf("Expected header %q, got %q", tc.header, *a.header.Load())
+				}
+			case *TokenAuth:
+				if tc.header != "" {
+					t.Errorf("Expected static auth, got token auth")
+				}
+				if a.creds.Load().username != tc.tokenUser || a.anonymous != (tc.tokenUser == "") {
+					t.Errorf("Unexpected token auth user %q anonymous %t", a.creds.Load().username, a.anonymous)
+				}
+			default:
+				t.Fatalf("Unexpected auth type %T", auth)
+			}
+		})
+	}
+}
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		registry string
+		user     string
+		pass     string
+		err      string
+	}{
+		{name: "username and password", config: `{"auths":{"quay.io":{"username":"u","password":"p"}}}`, registry: "https://quay.io", user: "u", pass: "p"},
+		{name: "identity token", config: `{"auths":{"quay.io":{"username":"<token>","identitytoken":"idt"}}}`, registry: "https://quay.io", user: "<token>", pass: "idt"},
+		{name: "docker hub", config: `{"auths":{"https://index.docker.io/v1/":{"username":"u","password":"p"}}}`, registry: "https://registry-1.docker.io", user: "u", pass: "p"},
+		{name: "invalid auth", config: `{"auths":{"quay.io":{"auth":"bm9jb2xvbg=="}}}`, registry: "https://quay.io", err: "invalid auth"},
+		{name: "empty entry", config: `{"auths":{"quay.io":{}}}`, registry: "https://quay.io", err: "no usable credentials"},
+		{name: "invalid json", config: `{`, registry: "https://quay.io", err: "unable to parse docker config"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			creds, err := credentialsFromDockerConfig([]byte(tc.config), tc.registry)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if creds.Username != tc.user || creds.Password != tc.pass {
+				t.Errorf("Expected %s:%s, got %s:%s", tc.user, tc.pass, creds.Username, creds.Password)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// UpstreamConfig configures one registry of a backend
+type UpstreamConfig struct {
+	URL  string     `json:"url"`
+	Auth AuthConfig `json:"auth,omitempty"`
+	// Redirects is passthrough (the default) or follow
+	Redirects string `json:"redirects,omitempty"`
+}
+
+// BackendConfig configures a backend as an ordered group of mirrored upstreams.
+// The first upstream is the primary, the others are tried in order when it fails.
+type BackendConfig struct {
+	Upstreams []UpstreamConfig `json:"upstreams"`
+}
+
+// LoadBackendConfig reads a YAML or JSON backend configuration file
+func LoadBackendConfig(path string) (*BackendConfig, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- config path comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backend config: %s", err)
+	}
+	var cfg BackendConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse backend config: %s", err)
+	}
+	return &cfg, nil
+}
+
+// NewBackendFromConfig constructs the backend and the BackendAuth of each of its upstreams
+func NewBackendFromConfig(ctx context.Context, cfg *BackendConfig) (*BackendProxy, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, errors.New("no backend upstreams configured")
+	}
+
+	auths := make([]BackendAuth, len(cfg.Upstreams))
+	for i, u := range cfg.Upstreams {
+		auth, err := NewBackendAuth(ctx, u.Auth, u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure auth for %s: %s", u.URL, err)
+		}
+		auths[i] = auth
+	}
+
+	var mirrors []*BackendProxy
+	for i, u := range cfg.Upstreams[1:] {
+		bp, err := NewBackendProxy(u.URL, auths[i+1], u.Redirects)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, bp)
+	}
+	primary := cfg.Upstreams[0]
+	return NewBackendProxy(primary.URL, auths[0], primary.Redirects, mirrors...)
+}
+
+// FollowsRedirects reports whether every upstream streams redirected blobs instead of returning the redirect
+func (c *BackendConfig) FollowsRedirects() bool {
+	for _, u := range c.Upstreams {
+		if u.Redirects != RedirectFollow {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBackendConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backend.yaml")
+	writeFile(t, path, `upstreams:
+- url: https://quay.io
+  auth:
+    type: bearer
+    token: primary
+- url: https://mirror.example.com
+  auth:
+    type: anonymous
+  redirects: follow
+`)
+	cfg, err := LoadBackendConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(cfg.Upstreams) != 2 || cfg.Upstreams[1].Redirects != RedirectFollow || cfg.Upstreams[0].Auth.Token != "primary" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+
+	if cfg.FollowsRedirects() {
+		t.Error("Expected the passthrough primary not to follow redirects")
+	}
+	cfg.Upstreams[0].Redirects = RedirectFollow
+	if !cfg.FollowsRedirects() {
+		t.Error("Expected every upstream to follow redirects")
+	}
+
+	bp, err := NewBackendFromConfig(t.Context(), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if bp.URL != "https://quay.io" || len(bp.mirrors) != 1 || bp.mirrors[0].URL != "https://mirror.example.com" {
+		t.Errorf("Unexpected backend %s with mirrors %v", bp.URL, bp.mirrors)
+	}
+
+	badPath := filepath.Join(dir, "bad.yaml")
+	writeFile(t, badPath, "upstream:\n- url: https://quay.io\n")
+	if _, err := LoadBackendConfig(badPath); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+	if _, err := NewBackendFromConfig(t.Context(), &BackendConfig{}); err == nil {
+		t.Error("Expected an error without upstreams")
+	}
+}
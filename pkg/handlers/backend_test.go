@@ -1,12 +1,27 @@
 package handlers
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"image-rbac-proxy/pkg/tests"
+	"image-rbac-proxy/pkg/utils"
 )
 
+func newTestBackend(t *testing.T, url string, auth BackendAuth, redirects string) *BackendProxy {
+	t.Helper()
+	bp, err := NewBackendProxy(url, auth, redirects)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	return bp
+}
+
 func TestRegistryHandlerNoAuth(t *testing.T) {
 	r := httptest.NewRequest("GET", "/v2/", nil)
 	rr := httptest.NewRecorder()
@@ -24,7 +39,7 @@ func NewTestAuth(user string) *TestAuth {
 	return &TestAuth{username: user}
 }
 
-func (a *TestAuth) AuthorizationHeader(bp *BackendProxy, repo string) (string, error) {
+func (a *TestAuth) AuthorizationHeader(_ context.Context, bp *BackendProxy, repo string) (string, error) {
 	if a.username != "" {
 		return "Bearer token-for-" + a.username + "-" + repo, nil
 	}
@@ -62,8 +77,7 @@ func TestRegistryHandler(t *testing.T) {
 	for _, tt := range registryTests {
 		t.Run(tt.name, func(t *testing.T) {
 			auth := NewTestAuth(tt.username)
-			bp := BackendProxy{URL: origin.URL, Auth: auth}
-			BackendRegistry = &bp
+			BackendRegistry = newTestBackend(t, origin.URL, auth, "")
 
 			r := httptest.NewRequest("GET", "/v2/foobar/manifests/latest", nil)
 			rr := httptest.NewRecorder()
@@ -74,3 +88,100 @@ func TestRegistryHandler(t *testing.T) {
 		})
 	}
 }
+
+type challengeAuth struct {
+	TestAuth
+	invalidated bool
+}
+
+func (a *challengeAuth) InvalidateChallenge() {
+	a.invalidated = true
+}
+
+func TestRegistryHandlerInvalidatesChallenge(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+
+	auth := &challengeAuth{TestAuth: TestAuth{username: "test"}}
+	BackendRegistry = newTestBackend(t, origin.URL, auth, "")
+
+	r := httptest.NewRequest("GET", "/v2/foobar/manifests/latest", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+	if !auth.invalidated {
+		t.Error("Expected backend 401 to invalidate the auth challenge")
+	}
+}
+
+func TestNewBackendProxy(t *testing.T) {
+	backendTests := []struct {
+		name      string
+		url       string
+		auth      BackendAuth
+		redirects string
+		wantErr   bool
+	}{
+		{"Valid backend", "https://quay.io", NewAnonymousAuth(), "", false},
+		{"Follow redirects", "http://registry.local:5000", NewAnonymousAuth(), RedirectFollow, false},
+		{"Unparseable url", "https://bad registry", NewAnonymousAuth(), "", true},
+		{"Relative url", "quay.io", NewAnonymousAuth(), "", true},
+		{"Unsupported scheme", "ftp://quay.io", NewAnonymousAuth(), "", true},
+		{"Missing auth", "https://quay.io", nil, "", true},
+		{"Unsupported redirect mode", "https://quay.io", NewAnonymousAuth(), "rewrite", true},
+	}
+
+	for _, tt := range backendTests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp, err := NewBackendProxy(tt.url, tt.auth, tt.redirects)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %t, but got %v", tt.wantErr, err)
+			}
+			if err == nil && bp.Proxy == nil {
+				t.Error("Expected reverse proxy to be set up")
+			}
+		})
+	}
+}
+
+// TestRegistryHandlerConcurrent exercises the shared backend from many goroutines; run with -race
+func TestRegistryHandlerConcurrent(t *testing.T) {
+	token := tests.GenToken(time.Now(), "quay")
+	origin := originAuthServer(token)
+	defer origin.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			// Challenge with the auth server so the token flow runs concurrently
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+origin.URL+`/v2/auth",service="service"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("manifest"))
+	}))
+	defer registry.Close()
+
+	cacheClient := utils.CacheClient
+	utils.CacheClient = nil
+	defer func() { utils.CacheClient = cacheClient }()
+
+	BackendRegistry = newTestBackend(t, registry.URL, NewTokenAuth("test", "test"), "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/v2/foobar/manifests/latest", nil)
+			if i%2 == 0 {
+				r = httptest.NewRequest("HEAD", "/v2/foobar/manifests/latest", nil)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+			if rr.Code != http.StatusOK {
+				t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// circuitBreaker fails requests fast once the backend failed threshold times in a row.
+// After the cooldown a single probe request is let through, closing the breaker again if it succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	probing   bool
+	openedAt  time.Time
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	onChange  func(state int)
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(state int)) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, onChange: onChange}
+}
+
+// allow reports whether a request may be sent to the backend
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record reports the outcome of an allowed request
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// cancel releases an allowed request that ended without an outcome, such as a client disconnect
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// open reports whether requests are currently failed fast
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && b.now().Sub(b.openedAt) < b.cooldown
+}
+
+// setState changes the state, notifying onChange. Callers must hold b.mu.
+func (b *circuitBreaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
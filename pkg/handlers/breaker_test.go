@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	var states []int
+	b := newCircuitBreaker(2, time.Minute, func(s int) { states = append(states, s) })
+	b.now = func() time.Time { return now }
+
+	b.record(false)
+	if !b.allow() || b.open() {
+		t.Fatal("Expected breaker to stay closed below the threshold")
+	}
+	b.record(false)
+	if b.allow() || !b.open() {
+		t.Fatal("Expected breaker to open at the threshold")
+	}
+
+	// After the cooldown a single probe is let through
+	now = now.Add(time.Minute)
+	if b.open() {
+		t.Error("Expected breaker to report ready once the cooldown elapsed")
+	}
+	if !b.allow() {
+		t.Fatal("Expected probe to be allowed")
+	}
+	if b.allow() {
+		t.Error("Expected concurrent requests to fail fast while probing")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Error("Expected failed probe to reopen the breaker")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("Expected probe to be allowed")
+	}
+	b.cancel()
+	if !b.allow() {
+		t.Fatal("Expected cancelled probe to let another probe through")
+	}
+	b.record(true)
+	if !b.allow() || !b.allow() {
+		t.Error("Expected successful probe to close the breaker")
+	}
+
+	expected := []int{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected state changes %v, got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("Expected state changes %v, got %v", expected, states)
+			break
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// cloudCredentialMargin is how long before expiry cloud registry credentials are refreshed
+const cloudCredentialMargin = 5 * time.Minute
+
+// cloudCredentials obtains short-lived registry credentials from a cloud provider
+type cloudCredentials func(ctx context.Context) (*registryCredentials, time.Time, error)
+
+// cloudAuth refreshes registry credentials from a cloud provider before they expire.
+// Requests are authorized by the BackendAuth of authType built from the current credentials.
+type cloudAuth struct {
+	authType string
+	provider cloudCredentials
+	mu       sync.Mutex
+	auth     BackendAuth
+	expires  time.Time
+}
+
+func newCloudAuth(authType string, provider cloudCredentials) *cloudAuth {
+	return &cloudAuth{authType: authType, provider: provider}
+}
+
+// AuthorizationHeader returns an Authorization header built from the current cloud credentials
+func (a *cloudAuth) AuthorizationHeader(ctx context.Context, bp *BackendProxy, repo string) (string, error) {
+	auth, err := a.current(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.AuthorizationHeader(ctx, bp, repo)
+}
+
+// current returns the BackendAuth for the current credentials, refreshing them if they are about to expire
+func (a *cloudAuth) current(ctx context.Context) (BackendAuth, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.auth != nil && time.Now().Before(a.expires.Add(-cloudCredentialMargin)) {
+		return a.auth, nil
+	}
+
+	creds, expires, err := a.provider(context.WithoutCancel(ctx))
+	if err != nil {
+		metrics.BackendCredentialReloads.WithLabelValues("error").Inc()
+		if a.auth != nil && time.Now().Before(a.expires) {
+			// Keep using credentials that have not expired yet
+			logrus.Errorf("Unable to refresh cloud registry credentials: %s", err)
+			return a.auth, nil
+		}
+		return nil, fmt.Errorf("unable to obtain cloud registry credentials: %s", err)
+	}
+
+	if a.auth == nil {
+		a.auth, err = authFromCredentials(a.authType, creds)
+	} else {
+		err = updateCredentials(a.auth, a.authType, creds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.BackendCredentialReloads.WithLabelValues("rotated").Inc()
+	a.expires = expires
+	return a.auth, nil
+}
+
+// InvalidateToken drops the cached token of a repository if the current BackendAuth caches tokens
+func (a *cloudAuth) InvalidateToken(bp *BackendProxy, repo string) {
+	a.mu.Lock()
+	tc, ok := a.auth.(tokenCache)
+	a.mu.Unlock()
+	if ok {
+		tc.InvalidateToken(bp, repo)
+	}
+}
+
+// InvalidateChallenge drops the cached auth challenge if the current BackendAuth caches it
+func (a *cloudAuth) InvalidateChallenge() {
+	a.mu.Lock()
+	cc, ok := a.auth.(challengeCache)
+	a.mu.Unlock()
+	if ok {
+		cc.InvalidateChallenge()
+	}
+}
+
+// newCloudClient returns the HTTP client used for cloud credential exchanges
+func newCloudClient() *http.Client {
+	return &http.Client{Transport: tracing.Transport(utils.Transport), Timeout: 30 * time.Second}
+}
+
+// doJSON sends a request and decodes a JSON response, failing on non-200 statuses
+func doJSON(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req) // #nosec G704 -- cloud credential endpoints come from trusted configuration
+	if err != nil {
+		return fmt.Errorf("unable to request %s: %s", req.URL.Host, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response from %s: %s", req.URL.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status %d received from %s: %s", resp.StatusCode, req.URL.Host, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unable to parse response from %s: %s", req.URL.Host, err)
+	}
+	return nil
+}
+
+// postForm posts form values and decodes the JSON response
+func postForm(ctx context.Context, client *http.Client, endpoint string, values url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doJSON(client, req, out)
+}
+
+// firstNonEmpty returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"image-rbac-proxy/pkg/tests"
+)
+
+func TestCloudAuthRefresh(t *testing.T) {
+	calls := 0
+	expires := time.Now().Add(time.Hour)
+	var providerErr error
+	auth := newCloudAuth(AuthTypeBasic, func(ctx context.Context) (*registryCredentials, time.Time, error) {
+		calls++
+		if providerErr != nil {
+			return nil, time.Time{}, providerErr
+		}
+		return &registryCredentials{Username: "user", Password: fmt.Sprintf("pass%d", calls)}, expires, nil
+	})
+	bp := BackendProxy{URL: "https://registry.example.com"}
+	basic := func(pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte("user:"+pass))
+	}
+
+	header, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
+	if err != nil || header != basic("pass1") {
+		t.Fatalf("Unexpected header %q, error %v", header, err)
+	}
+	if header, _ = auth.AuthorizationHeader(context.Background(), &bp, "foobar"); header != basic("pass1") || calls != 1 {
+		t.Errorf("Expected unexpired credentials to be reused, got %q after %d calls", header, calls)
+	}
+
+	// Credentials about to expire are refreshed
+	auth.expires = time.Now().Add(time.Minute)
+	if header, _ = auth.AuthorizationHeader(context.Background(), &bp, "foobar"); header != basic("pass2") {
+		t.Errorf("Expected refreshed credentials, got %q", header)
+	}
+
+	// Failed refreshes keep using credentials that have not expired yet
+	auth.expires = time.Now().Add(time.Minute)
+	providerErr = errors.New("unavailable")
+	if header, err = auth.AuthorizationHeader(context.Background(), &bp, "foobar"); err != nil || header != basic("pass2") {
+		t.Errorf("Expected previous credentials, got %q, error %v", header, err)
+	}
+	auth.expires = time.Now().Add(-time.Minute)
+	if _, err = auth.AuthorizationHeader(context.Background(), &bp, "foobar"); err == nil {
+		t.Error("Expected error once credentials expired")
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	keys := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, keys, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func ecrServer(t *testing.T, expectedKeyID string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+expectedKeyID+"/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/ecr/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		token := base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password"))
+		_, _ = fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":"%s","expiresAt":%d.5}]}`, token, time.Now().Add(12*time.Hour).Unix())
+	}))
+}
+
+func TestECRCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	ecr := ecrServer(t, "AKID")
+	defer ecr.Close()
+
+	auth, err := NewBackendAuth(context.Background(), AuthConfig{Type: AuthTypeECR, Endpoint: ecr.URL}, "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	bp := BackendProxy{URL: "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"}
+	header, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")); header != expected {
+		t.Errorf("Expected %s, got %s", expected, header)
+	}
+}
+
+func TestECRWebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("web-identity"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "web-identity" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>` +
+			`<AccessKeyId>ASIA</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>` +
+			`</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	ecr := ecrServer(t, "ASIA")
+	defer ecr.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/proxy")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+	t.Setenv("AWS_ENDPOINT_URL_ECR", ecr.URL)
+
+	provider, err := newECRCredentials(AuthConfig{}, "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	creds, expires, err := provider(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if creds.Username != "AWS" || creds.Password != "ecr-password" {
+		t.Errorf("Unexpected credentials %+v", creds)
+	}
+	if time.Until(expires) < 11*time.Hour {
+		t.Errorf("Unexpected expiry %s", expires)
+	}
+}
+
+func TestECRRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	if _, err := newECRCredentials(AuthConfig{}, "https://registry.example.com"); err == nil {
+		t.Error("Expected error when the region cannot be determined")
+	}
+	t.Setenv("AWS_REGION", "us-east-2")
+	if _, err := newECRCredentials(AuthConfig{}, "https://registry.example.com"); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+}
+
+func TestGCPMetadataCredentials(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"ya29.metadata","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer metadata.Close()
+
+	provider, err := newGCPCredentials(AuthConfig{Endpoint: metadata.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	creds, expires, err := provider(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if creds.Username != gcpRegistryUser || creds.Password != "ya29.metadata" {
+		t.Errorf("Unexpected credentials %+v", creds)
+	}
+	if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Unexpected expiry %s", expires)
+	}
+}
+
+func TestGCPServiceAccountCredentials(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	var tokenURI string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(r.Form.Get("assertion"), claims, func(*jwt.Token) (interface{}, error) {
+			return &privateKey.PublicKey, nil
+		})
+		if err != nil || claims["iss"] != "proxy@project.iam.gserviceaccount.com" || claims["aud"] != tokenURI {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"ya29.key","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	tokenURI = tokenServer.URL + "/token"
+
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	key, _ := json.Marshal(gcpServiceAccountKey{
+		Type:        "service_account",
+		ClientEmail: "proxy@project.iam.gserviceaccount.com",
+		PrivateKey:  string(keyPEM),
+		TokenURI:    tokenURI,
+	})
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+
+	provider, err := newGCPCredentials(AuthConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	creds, _, err := provider(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if creds.Password != "ya29.key" {
+		t.Errorf("Unexpected credentials %+v", creds)
+	}
+}
+
+func TestACRCredentials(t *testing.T) {
+	refreshToken := tests.GenToken(time.Now().Add(3*time.Hour), "acr")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		switch r.URL.Path {
+		case "/tenant/oauth2/v2.0/token":
+			if r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" || r.Form.Get("scope") != acrScope {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"aad-token"}`))
+		case "/oauth2/exchange":
+			if r.Form.Get("access_token") != "aad-token" || r.Form.Get("tenant") != "tenant" || r.Form.Get("service") != r.Host {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"refresh_token":"%s"}`, refreshToken)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+
+	provider, err := newACRCredentials(AuthConfig{Endpoint: server.URL}, server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	creds, expires, err := provider(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if creds.Username != acrRefreshTokenUser || creds.Password != refreshToken {
+		t.Errorf("Unexpected credentials %+v", creds)
+	}
+	if d := time.Until(expires); d < 2*time.Hour {
+		t.Errorf("Expected expiry from the refresh token, got %s", expires)
+	}
+}
+
+func TestACRCredentialsNotConfigured(t *testing.T) {
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+	if _, err := newACRCredentials(AuthConfig{}, "https://example.azurecr.io"); err == nil {
+		t.Error("Expected error without a client secret or federated token")
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// loadCredentials reads the backend credentials referenced by the config.
+// Values from a secret override inline values, and values from files override both.
+func loadCredentials(ctx context.Context, cfg AuthConfig, registryURL string) (*registryCredentials, error) {
+	if cfg.Type == AuthTypeDockerConfig {
+		data, err := readDockerConfig(ctx, cfg.DockerConfigPath, cfg.DockerConfigSecret)
+		if err != nil {
+			return nil, err
+		}
+		return credentialsFromDockerConfig(data, registryURL)
+	}
+
+	creds := &registryCredentials{Username: cfg.Username, Password: cfg.Password, RegistryToken: cfg.Token}
+	if cfg.CredentialsSecret != "" {
+		s, err := getSecret(ctx, cfg.CredentialsSecret)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := s.Data["username"]; ok {
+			creds.Username = strings.TrimSpace(string(v))
+		}
+		if v, ok := s.Data["password"]; ok {
+			creds.Password = strings.TrimSpace(string(v))
+		}
+		if v, ok := s.Data["token"]; ok {
+			creds.RegistryToken = strings.TrimSpace(string(v))
+		}
+	}
+	for _, f := range []struct {
+		path  string
+		value *string
+	}{
+		{cfg.UsernameFile, &creds.Username},
+		{cfg.PasswordFile, &creds.Password},
+		{cfg.TokenFile, &creds.RegistryToken},
+	} {
+		if f.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.path) // #nosec G304 -- credential paths come from trusted configuration
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials: %s", err)
+		}
+		*f.value = strings.TrimSpace(string(data))
+	}
+	return creds, nil
+}
+
+// rotatable reports whether the config reads credentials from a source that can change at runtime
+func (cfg AuthConfig) rotatable() bool {
+	return cfg.UsernameFile != "" || cfg.PasswordFile != "" || cfg.TokenFile != "" || cfg.CredentialsSecret != "" ||
+		cfg.DockerConfigPath != "" || cfg.DockerConfigSecret != ""
+}
+
+// watchCredentials polls the credential sources of the config until ctx is done, swapping changed credentials into auth.
+// The interval is read from BACKEND_CREDENTIALS_REFRESH_INTERVAL.
+func watchCredentials(ctx context.Context, cfg AuthConfig, registryURL string, auth BackendAuth, current *registryCredentials) {
+	ticker := time.NewTicker(utils.EnvDuration("BACKEND_CREDENTIALS_REFRESH_INTERVAL", 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		creds, err := loadCredentials(ctx, cfg, registryURL)
+		if err != nil {
+			metrics.BackendCredentialReloads.WithLabelValues("error").Inc()
+			logrus.Errorf("Unable to reload backend credentials: %s", err)
+			continue
+		}
+		if *creds == *current {
+			continue
+		}
+		if err := updateCredentials(auth, cfg.Type, creds); err != nil {
+			metrics.BackendCredentialReloads.WithLabelValues("error").Inc()
+			logrus.Errorf("Unable to rotate backend credentials: %s", err)
+			continue
+		}
+		metrics.BackendCredentialReloads.WithLabelValues("rotated").Inc()
+		logrus.Printf("Rotated credentials for registry backend with URL %s", registryURL)
+		current = creds
+	}
+}
+
+// updateCredentials atomically swaps new credentials into a BackendAuth built by authFromCredentials
+func updateCredentials(auth BackendAuth, authType string, creds *registryCredentials) error {
+	fresh, err := authFromCredentials(authType, creds)
+	if err != nil {
+		return err
+	}
+	switch a := auth.(type) {
+	case *TokenAuth:
+		if _, ok := fresh.(*TokenAuth); !ok {
+			return fmt.Errorf("credentials changed from %T to %T, restart required", auth, fresh)
+		}
+		a.SetCredentials(creds.Username, creds.Password)
+	case *StaticAuth:
+		s, ok := fresh.(*StaticAuth)
+		if !ok {
+			return fmt.Errorf("credentials changed from %T to %T, restart required", auth, fresh)
+		}
+		a.header.Store(s.header.Load())
+	default:
+		return fmt.Errorf("credentials of %T cannot be rotated", auth)
+	}
+	return nil
+}
+
+// getSecret reads a Kubernetes secret given as namespace/name
+func getSecret(ctx context.Context, ref string) (*corev1.Secret, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		return nil, fmt.Errorf("secret %q must be in the form namespace/name", ref)
+	}
+	config := &rest.Config{
+		Host:        os.Getenv("CLUSTER_URL"),
+		BearerToken: os.Getenv("OAUTH_TOKEN"),
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kubernetes client: %s", err)
+	}
+	s, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get secret %s: %s", ref, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	// Write and rename like a kubelet secret update so readers never see partial content
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	writeFile(t, passwordFile, "from-file\n")
+
+	testCases := []struct {
+		name     string
+		cfg      AuthConfig
+		expected registryCredentials
+		err      bool
+	}{
+		{name: "inline", cfg: AuthConfig{Username: "u", Password: "p"}, expected: registryCredentials{Username: "u", Password: "p"}},
+		{name: "file overrides inline", cfg: AuthConfig{Username: "u", Password: "p", PasswordFile: passwordFile}, expected: registryCredentials{Username: "u", Password: "from-file"}},
+		{name: "token file", cfg: AuthConfig{Type: AuthTypeBearer, TokenFile: passwordFile}, expected: registryCredentials{RegistryToken: "from-file"}},
+		{name: "missing file", cfg: AuthConfig{PasswordFile: filepath.Join(dir, "missing")}, err: true},
+		{name: "invalid secret reference", cfg: AuthConfig{CredentialsSecret: "secret"}, err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			creds, err := loadCredentials(context.Background(), tc.cfg, "https://quay.io")
+			if tc.err {
+				if err == nil {
+					t.Fatal("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if *creds != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, *creds)
+			}
+		})
+	}
+}
+
+func TestCredentialRotation(t *testing.T) {
+	t.Setenv("BACKEND_CREDENTIALS_REFRESH_INTERVAL", "10ms")
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	tokenFile := filepath.Join(dir, "token")
+	writeFile(t, usernameFile, "robot")
+	writeFile(t, passwordFile, "old")
+	writeFile(t, tokenFile, "old")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auth, err := NewBackendAuth(ctx, AuthConfig{UsernameFile: usernameFile, PasswordFile: passwordFile}, "https://quay.io")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	tokenAuth := auth.(*TokenAuth)
+	oldCreds := tokenAuth.creds.Load()
+
+	bearer, err := NewBackendAuth(ctx, AuthConfig{Type: AuthTypeBearer, TokenFile: tokenFile}, "https://quay.io")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	writeFile(t, passwordFile, "new")
+	writeFile(t, tokenFile, "new")
+
+	bp := BackendProxy{URL: "https://quay.io"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		header, _ := bearer.AuthorizationHeader(ctx, &bp, "foobar")
+		if tokenAuth.creds.Load().password == "new" && header == "Bearer new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Credentials were not rotated: password %q, header %q", tokenAuth.creds.Load().password, header)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	newCreds := tokenAuth.creds.Load()
+	if newCreds.username != "robot" {
+		t.Errorf("Expected username to be kept, got %q", newCreds.username)
+	}
+	if tokenCacheKey(bp.URL, "foobar", oldCreds.fingerprint) == tokenCacheKey(bp.URL, "foobar", newCreds.fingerprint) {
+		t.Error("Expected tokens of rotated credentials to use a new cache key")
+	}
+}
+
+func TestUpdateCredentialsTypeChange(t *testing.T) {
+	auth := NewTokenAuth("u", "p")
+	if err := updateCredentials(auth, AuthTypeDockerConfig, &registryCredentials{RegistryToken: "t"}); err == nil {
+		t.Error("Expected error when credentials change from token exchange to a registry token")
+	}
+	if auth.creds.Load().password != "p" {
+		t.Error("Expected credentials to be kept after a failed rotation")
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dockerConfig is the format of ~/.docker/config.json, auth.json and dockerconfigjson secrets
+type dockerConfig struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// registryCredentials are credentials for one registry found in a docker config
+type registryCredentials struct {
+	Username      string
+	Password      string
+	RegistryToken string
+}
+
+// credentialsFromDockerConfig returns the credentials for the registry serving registryURL
+func credentialsFromDockerConfig(data []byte, registryURL string) (*registryCredentials, error) {
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse docker config: %s", err)
+	}
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable parse registry url: %s", err)
+	}
+
+	for key, entry := range cfg.Auths {
+		if registryHost(key) != u.Host {
+			continue
+		}
+		creds := &registryCredentials{Username: entry.Username, Password: entry.Password, RegistryToken: entry.RegistryToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode auth for %s: %s", key, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for %s", key)
+			}
+			creds.Username, creds.Password = user, pass
+		}
+		if entry.IdentityToken != "" {
+			creds.Password = entry.IdentityToken
+		}
+		if creds.RegistryToken == "" && (creds.Username == "" || creds.Password == "") {
+			return nil, fmt.Errorf("no usable credentials for %s", key)
+		}
+		return creds, nil
+	}
+	return nil, fmt.Errorf("no credentials for %s in docker config", u.Host)
+}
+
+// registryHost normalizes docker config keys such as "https://quay.io/v1/" to a host
+func registryHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	if host == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// readDockerConfig loads a docker config from a file or from a Kubernetes secret given as namespace/name
+func readDockerConfig(ctx context.Context, path, secret string) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path) // #nosec G304 -- docker config path comes from trusted configuration
+		if err != nil {
+			return nil, fmt.Errorf("unable to read docker config: %s", err)
+		}
+		return data, nil
+	}
+	if secret == "" {
+		return nil, errors.New("docker config path or secret is not specified")
+	}
+
+	s, err := getSecret(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := s.Data[corev1.DockerConfigJsonKey]; ok {
+		return data, nil
+	}
+	if data, ok := s.Data[corev1.DockerConfigKey]; ok {
+		// Legacy .dockercfg secrets hold the auths map directly
+		return []byte(`{"auths":` + string(data) + `}`), nil
+	}
+	return nil, fmt.Errorf("secret %s has no docker config", secret)
+}
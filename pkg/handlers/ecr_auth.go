@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ecrHost matches ECR registry hosts such as 123456789012.dkr.ecr.eu-west-1.amazonaws.com
+var ecrHost = regexp.MustCompile(`\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// awsCredentials are AWS access keys used to sign requests
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type ecrAuthorizationResponse struct {
+	AuthorizationData []struct {
+		AuthorizationToken string  `json:"authorizationToken"`
+		ExpiresAt          float64 `json:"expiresAt"`
+	} `json:"authorizationData"`
+}
+
+// newECRCredentials returns a provider calling ECR GetAuthorizationToken.
+// Access keys are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or exchanged for the web identity token at AWS_WEB_IDENTITY_TOKEN_FILE.
+// The ECR API endpoint is the configured endpoint, AWS_ENDPOINT_URL_ECR or the regional endpoint.
+func newECRCredentials(cfg AuthConfig, registryURL string) (cloudCredentials, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable parse registry url: %s", err)
+	}
+	region := os.Getenv("AWS_REGION")
+	if m := ecrHost.FindStringSubmatch(u.Hostname()); m != nil {
+		region = m[2]
+	}
+	region = firstNonEmpty(region, os.Getenv("AWS_DEFAULT_REGION"))
+	if region == "" {
+		return nil, errors.New("unable to determine the AWS region of the ECR registry")
+	}
+	endpoint := firstNonEmpty(cfg.Endpoint, os.Getenv("AWS_ENDPOINT_URL_ECR"), "https://api.ecr."+region+".amazonaws.com")
+	client := newCloudClient()
+
+	return func(ctx context.Context) (*registryCredentials, time.Time, error) {
+		keys, err := awsAccessKeys(ctx, client, region)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		body := []byte("{}")
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to create request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+		signV4(req, body, keys, region, "ecr", time.Now())
+
+		var resp ecrAuthorizationResponse
+		if err := doJSON(client, req, &resp); err != nil {
+			return nil, time.Time{}, err
+		}
+		if len(resp.AuthorizationData) == 0 {
+			return nil, time.Time{}, errors.New("no authorization data received from ECR")
+		}
+		data := resp.AuthorizationData[0]
+		decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to decode ECR authorization token: %s", err)
+		}
+		user, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, time.Time{}, errors.New("invalid ECR authorization token")
+		}
+		sec, frac := math.Modf(data.ExpiresAt)
+		return &registryCredentials{Username: user, Password: pass}, time.Unix(int64(sec), int64(frac*1e9)), nil
+	}, nil
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string `xml:"SecretAccessKey"`
+		SessionToken    string `xml:"SessionToken"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// awsAccessKeys returns static access keys from the environment or assumes AWS_ROLE_ARN with a web identity token
+func awsAccessKeys(ctx context.Context, client *http.Client, region string) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return nil, errors.New("AWS credentials are not specified")
+	}
+	token, err := os.ReadFile(tokenFile) // #nosec G304 -- token path comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("unable to read web identity token: %s", err)
+	}
+
+	endpoint := firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_STS"), "https://sts."+region+".amazonaws.com")
+	values := url.Values{}
+	values.Set("Action", "AssumeRoleWithWebIdentity")
+	values.Set("Version", "2011-06-15")
+	values.Set("RoleArn", roleARN)
+	values.Set("RoleSessionName", firstNonEmpty(os.Getenv("AWS_ROLE_SESSION_NAME"), "image-rbac-proxy"))
+	values.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req) // #nosec G704 -- STS endpoint comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("unable to assume role: %s", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status %d received from STS", resp.StatusCode)
+	}
+	var result assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to parse STS response: %s", err)
+	}
+	return &awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+	}, nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to the request, signing all of its headers
+func signV4(req *http.Request, body []byte, keys *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if keys.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", keys.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+keys.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keys.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// maxErrorBody bounds how much of an error response is read to find its error code
+const maxErrorBody = 64 << 10
+
+// failoverTransport sends requests to an ordered group of mirrored upstreams, each with its own credentials.
+// Idempotent requests move on to the next upstream on connection errors, 5xx responses and unknown manifests.
+type failoverTransport struct {
+	upstreams []*BackendProxy
+}
+
+// RoundTrip sends the request to the first upstream able to serve it
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	repo := utils.RepoFromPath(req.URL.Path)
+	last := len(t.upstreams) - 1
+	if !isIdempotent(req) {
+		last = 0
+	}
+
+	var lastErr error
+	for i, u := range t.upstreams[:last+1] {
+		if i < last && !u.Ready() {
+			continue
+		}
+		header, err := u.Auth.AuthorizationHeader(req.Context(), u, repo)
+		if err != nil {
+			logrus.Errorf("Unable to fetch credentials for registry backend %s: %s", u.URL, err)
+			lastErr = err
+			t.failover(u, i, last)
+			continue
+		}
+
+		out := req.Clone(req.Context())
+		out.URL.Scheme, out.URL.Host, out.Host = u.target.Scheme, u.target.Host, u.target.Host
+		if header != "" {
+			out.Header.Set("Authorization", header)
+		} else {
+			out.Header.Del("Authorization")
+		}
+
+		resp, err := u.transport.RoundTrip(out)
+		if i == last {
+			return resp, err
+		}
+		if err == nil {
+			if resp, err = peekFailover(out, resp); err == nil && resp != nil {
+				return resp, nil
+			}
+		}
+		lastErr = err
+		t.failover(u, i, last)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no backend registry available")
+	}
+	return nil, lastErr
+}
+
+func (t *failoverTransport) failover(u *BackendProxy, i, last int) {
+	if i < last {
+		metrics.BackendFailovers.WithLabelValues(u.URL).Inc()
+	}
+}
+
+// peekFailover returns the response if it should be served, or nil after closing it if the next upstream should be tried
+func peekFailover(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if isServerError(resp.StatusCode) {
+		_ = resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(req.URL.Path, "/manifests/") {
+		return resp, nil
+	}
+	if req.Method == http.MethodHead {
+		// HEAD responses carry no error body, so any missing manifest is unknown
+		_ = resp.Body.Close()
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if bytes.Contains(body, []byte(`"MANIFEST_UNKNOWN"`)) {
+		_ = resp.Body.Close()
+		return nil, nil
+	}
+	// Serve the response with the peeked bytes put back
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return resp, nil
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	t.Setenv("BACKEND_RETRIES", "0")
+
+	failoverTests := []struct {
+		name           string
+		method         string
+		path           string
+		primaryStatus  int
+		primaryBody    string
+		primaryDown    bool
+		wantStatus     int
+		wantMirrorHits int32
+	}{
+		{"Primary serves", "GET", "/v2/foo/bar/manifests/latest", http.StatusOK, "", false, http.StatusOK, 0},
+		{"Server error fails over", "GET", "/v2/foo/bar/blobs/sha256:abc", http.StatusServiceUnavailable, "", false, http.StatusOK, 1},
+		{"Unknown manifest fails over", "GET", "/v2/foo/bar/manifests/latest", http.StatusNotFound, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, false, http.StatusOK, 1},
+		{"Missing manifest HEAD fails over", "HEAD", "/v2/foo/bar/manifests/latest", http.StatusNotFound, "", false, http.StatusOK, 1},
+		{"Unknown name is served", "GET", "/v2/foo/bar/manifests/latest", http.StatusNotFound, `{"errors":[{"code":"NAME_UNKNOWN"}]}`, false, http.StatusNotFound, 0},
+		{"Missing blob is served", "GET", "/v2/foo/bar/blobs/sha256:abc", http.StatusNotFound, "", false, http.StatusNotFound, 0},
+		{"Connection error fails over", "GET", "/v2/foo/bar/manifests/latest", http.StatusOK, "", true, http.StatusOK, 1},
+		{"Non-idempotent request does not fail over", "POST", "/v2/foo/bar/blobs/uploads/", http.StatusServiceUnavailable, "", false, http.StatusServiceUnavailable, 0},
+	}
+
+	for _, tt := range failoverTests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer primary" {
+					t.Errorf("Expected primary credentials, but got %q", r.Header.Get("Authorization"))
+				}
+				w.WriteHeader(tt.primaryStatus)
+				_, _ = w.Write([]byte(tt.primaryBody))
+			}))
+			defer primary.Close()
+			if tt.primaryDown {
+				primary.Close()
+			}
+
+			var mirrorHits atomic.Int32
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mirrorHits.Add(1)
+				if r.Header.Get("Authorization") != "Bearer mirror" {
+					t.Errorf("Expected mirror credentials, but got %q", r.Header.Get("Authorization"))
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer mirror.Close()
+
+			bp, err := NewBackendProxy(primary.URL, NewBearerAuth("primary"), "", newTestBackend(t, mirror.URL, NewBearerAuth("mirror"), ""))
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			BackendRegistry = bp
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer client")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Expected code %d, but got %d", tt.wantStatus, rr.Code)
+			}
+			if n := mirrorHits.Load(); n != tt.wantMirrorHits {
+				t.Errorf("Expected %d mirror requests, but got %d", tt.wantMirrorHits, n)
+			}
+		})
+	}
+}
+
+func TestFailoverSkipsOpenBreaker(t *testing.T) {
+	t.Setenv("BACKEND_RETRIES", "0")
+	t.Setenv("BACKEND_BREAKER_FAILURES", "1")
+
+	var primaryHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mirror.Close()
+
+	bp, err := NewBackendProxy(primary.URL, NewBearerAuth("primary"), "", newTestBackend(t, mirror.URL, NewBearerAuth("mirror"), ""))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	BackendRegistry = bp
+
+	for range 3 {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(RegistryHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/v2/foo/bar/manifests/latest", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+		}
+	}
+	if n := primaryHits.Load(); n != 1 {
+		t.Errorf("Expected the open breaker to stop primary requests after 1, but got %d", n)
+	}
+	if !bp.Ready() {
+		t.Error("Expected the backend to be ready while a mirror is available")
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// gcpScope is the OAuth scope granting access to Artifact Registry and Container Registry
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpRegistryUser is the username registries accept with an OAuth access token as the password
+const gcpRegistryUser = "oauth2accesstoken"
+
+type gcpServiceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type gcpTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// newGCPCredentials returns a provider of OAuth access tokens for Artifact Registry and Container Registry.
+// Tokens are issued for the service account key at GOOGLE_APPLICATION_CREDENTIALS if set, otherwise by the metadata server.
+// The metadata server is the configured endpoint, GCE_METADATA_HOST or metadata.google.internal.
+func newGCPCredentials(cfg AuthConfig) (cloudCredentials, error) {
+	client := newCloudClient()
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		data, err := os.ReadFile(path) // #nosec G304 -- credentials path comes from trusted configuration
+		if err != nil {
+			return nil, fmt.Errorf("unable to read service account key: %s", err)
+		}
+		var key gcpServiceAccountKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("unable to parse service account key: %s", err)
+		}
+		if key.Type != "service_account" {
+			return nil, fmt.Errorf("unsupported credentials type %q", key.Type)
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse service account private key: %s", err)
+		}
+		tokenURI := firstNonEmpty(cfg.Endpoint, key.TokenURI, "https://oauth2.googleapis.com/token")
+
+		return func(ctx context.Context) (*registryCredentials, time.Time, error) {
+			now := time.Now()
+			assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+				"iss":   key.ClientEmail,
+				"scope": gcpScope,
+				"aud":   tokenURI,
+				"iat":   now.Unix(),
+				"exp":   now.Add(time.Hour).Unix(),
+			}).SignedString(privateKey)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("unable to sign token request: %s", err)
+			}
+			values := url.Values{}
+			values.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+			values.Set("assertion", assertion)
+			var resp gcpTokenResponse
+			if err := postForm(ctx, client, tokenURI, values, &resp); err != nil {
+				return nil, time.Time{}, err
+			}
+			return gcpRegistryCredentials(resp, now)
+		}, nil
+	}
+
+	metadataURL := firstNonEmpty(cfg.Endpoint, "http://"+firstNonEmpty(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal"))
+	tokenURL := metadataURL + "/computeMetadata/v1/instance/service-accounts/default/token"
+	return func(ctx context.Context) (*registryCredentials, time.Time, error) {
+		now := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to create request: %s", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		var resp gcpTokenResponse
+		if err := doJSON(client, req, &resp); err != nil {
+			return nil, time.Time{}, err
+		}
+		return gcpRegistryCredentials(resp, now)
+	}, nil
+}
+
+func gcpRegistryCredentials(resp gcpTokenResponse, issued time.Time) (*registryCredentials, time.Time, error) {
+	if resp.AccessToken == "" {
+		return nil, time.Time{}, errors.New("no access token received")
+	}
+	return &registryCredentials{Username: gcpRegistryUser, Password: resp.AccessToken},
+		issued.Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+}
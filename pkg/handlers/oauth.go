@@ -4,27 +4,36 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
-func newProvider() *oidc.Provider {
-	provider, err := oidc.NewProvider(context.Background(), os.Getenv("DEX_URL"))
+func newProvider(ctx context.Context) *oidc.Provider {
+	ctx, span := tracing.Start(ctx, "oidc.Discovery")
+	defer span.End()
+
+	provider, err := oidc.NewProvider(ctx, os.Getenv("DEX_URL"))
 	if err != nil {
+		tracing.RecordError(span, err)
 		logrus.Errorf("Error oidc provider: %s", err)
 		return nil
 	}
 	return provider
 }
 
-func getOauthConfig() oauth2.Config {
-	provider := newProvider()
+func getOauthConfig(r *http.Request) oauth2.Config {
+	provider := newProvider(r.Context())
 	if provider == nil {
 		return oauth2.Config{}
 	}
@@ -32,7 +41,7 @@ func getOauthConfig() oauth2.Config {
 	oauth2Config := oauth2.Config{
 		ClientID:     os.Getenv("DEX_CLIENT_ID"),
 		ClientSecret: os.Getenv("DEX_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("PROXY_URL") + "/oauth/callback",
+		RedirectURL:  utils.ExternalURL(r) + "/oauth/callback",
 		Endpoint:     provider.Endpoint(),
 		Scopes:       []string{oidc.ScopeOpenID, "email", "groups"},
 	}
@@ -48,7 +57,7 @@ func newState() string {
 
 // OauthHandler redirects user to dex
 func OauthHandler(w http.ResponseWriter, r *http.Request) {
-	oauth2Config := getOauthConfig()
+	oauth2Config := getOauthConfig(r)
 	state := newState()
 	if oauth2Config.ClientID != "" {
 		http.Redirect(w, r, oauth2Config.AuthCodeURL(state), http.StatusFound)
@@ -60,14 +69,14 @@ func OauthHandler(w http.ResponseWriter, r *http.Request) {
 
 // OauthCallbackHandler issues oauth token
 func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	oauth2Config := getOauthConfig()
+	oauth2Config := getOauthConfig(r)
 	if oauth2Config.ClientID == "" {
 		utils.ErrorHTTPResponse(w, utils.Unavailable, "Error getting oauth config")
 		return
 	}
 
 	// Exchange code for token
-	oauth2Token, err := oauth2Config.Exchange(context.Background(), r.URL.Query().Get("code"))
+	oauth2Token, err := oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"))
 	if err != nil {
 		utils.ErrorHTTPResponse(w, utils.Unavailable, "Error getting token from dex")
 		return
@@ -83,14 +92,20 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(rawIDToken)) // #nosec G705 -- OAuth callback intentionally returns the raw ID token
 }
 
-func VerifyIDToken(token string) (string, []string) {
-	provider := newProvider()
+func VerifyIDToken(ctx context.Context, token string) (string, []string) {
+	ctx, span := tracing.Start(ctx, "VerifyIDToken")
+	defer span.End()
+
+	provider := newProvider(ctx)
 	if provider == nil {
+		metrics.OIDCVerificationFailures.WithLabelValues("provider_unavailable").Inc()
 		return "", []string{}
 	}
 	idTokenVerifier := provider.Verifier(&oidc.Config{ClientID: os.Getenv("DEX_CLIENT_ID")})
-	idToken, err := idTokenVerifier.Verify(context.Background(), token)
+	idToken, err := idTokenVerifier.Verify(ctx, token)
 	if err != nil {
+		metrics.OIDCVerificationFailures.WithLabelValues(verificationFailureReason(err)).Inc()
+		tracing.RecordError(span, err)
 		logrus.Errorf("Error verifying token: %s", err)
 		return "", []string{}
 	}
@@ -101,8 +116,28 @@ func VerifyIDToken(token string) (string, []string) {
 		Groups []string `json:"groups"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
+		metrics.OIDCVerificationFailures.WithLabelValues("invalid_claims").Inc()
+		tracing.RecordError(span, err)
 		logrus.Errorf("Error extracting claims from token: %s", err)
 		return "", []string{}
 	}
+	span.SetAttributes(attribute.String("user", claims.Email))
 	return claims.Email, claims.Groups
 }
+
+// verificationFailureReason classifies an ID token verification error for metrics
+func verificationFailureReason(err error) string {
+	var expired *oidc.TokenExpiredError
+	switch {
+	case errors.As(err, &expired):
+		return "expired"
+	case strings.Contains(err.Error(), "audience"):
+		return "invalid_audience"
+	case strings.Contains(err.Error(), "issuer"):
+		return "invalid_issuer"
+	case strings.Contains(err.Error(), "signature"):
+		return "invalid_signature"
+	default:
+		return "malformed"
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"slices"
@@ -56,7 +57,7 @@ func TestVerifyIDToken(t *testing.T) {
 	t.Setenv("DEX_CLIENT_ID", "test-client")
 	token, _ := mockServer.GenIDToken("test-client", "user1", []string{"group1", "group2"})
 
-	email, groups := VerifyIDToken(token)
+	email, groups := VerifyIDToken(context.Background(), token)
 
 	if email != "user1" {
 		t.Errorf("Incorrect email: %s", email)
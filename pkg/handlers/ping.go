@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/utils"
 )
 
 // PingHandler simply responds with a pong
@@ -13,3 +15,15 @@ func PingHandler(w http.ResponseWriter, r *http.Request) {
 		logrus.Errorf("Ping failed with error: %s", err)
 	}
 }
+
+// ReadyHandler responds with 503 while the backend registry is unavailable
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if BackendRegistry != nil && !BackendRegistry.Ready() {
+		utils.ErrorHTTPResponse(w, utils.Unavailable, "Backend registry is unavailable")
+		return
+	}
+	_, err := w.Write([]byte("ready"))
+	if err != nil {
+		logrus.Errorf("Readiness check failed with error: %s", err)
+	}
+}
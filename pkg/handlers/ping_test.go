@@ -14,3 +14,13 @@ func TestPingHandler(t *testing.T) {
 		t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
 	}
 }
+
+func TestReadyHandler(t *testing.T) {
+	BackendRegistry = nil
+	r := httptest.NewRequest("GET", "/_ready", nil)
+	rr := httptest.NewRecorder()
+	ReadyHandler(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
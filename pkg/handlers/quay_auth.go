@@ -2,111 +2,197 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
 // TokenAuth contains credentials to be exchanged for a token
 type TokenAuth struct {
+	creds       atomic.Pointer[tokenCredentials]
+	anonymous   bool
+	tokenClient *http.Client
+	localCache  *utils.LRUCache
+	inflight    singleflight.Group
+	challengeMu sync.Mutex
+	challenge   *authChallenge
+}
+
+// maxLocalTokens bounds the number of tokens kept in process
+const maxLocalTokens = 1024
+
+// tokenTimeout bounds token requests to the backend registry, including reading the response
+const tokenTimeout = 30 * time.Second
+
+// challengeTTL is how long an auth challenge from the backend registry is reused
+const challengeTTL = time.Hour
+
+// authChallenge is the token service advertised by the backend registry
+type authChallenge struct {
+	registryURL string
+	realm       *url.URL
+	service     string
+	expires     time.Time
+}
+
+// tokenCredentials are the credentials exchanged for tokens.
+// The fingerprint is part of the token cache key so tokens issued to rotated credentials are not reused.
+type tokenCredentials struct {
 	username    string
 	password    string
-	tokenClient *http.Client
+	fingerprint string
 }
 
 type tokenResponse struct {
 	Token string
 }
 
+// errNoChallenge is returned when the backend registry does not require authentication
+var errNoChallenge = errors.New("no auth challenge presented by backend registry")
+
 // NewTokenAuth constructs a TokenAuth struct
 func NewTokenAuth(user, pass string) *TokenAuth {
-	return &TokenAuth{username: user, password: pass}
+	a := &TokenAuth{localCache: utils.NewLRUCache(maxLocalTokens), tokenClient: newTokenClient()}
+	a.SetCredentials(user, pass)
+	return a
+}
+
+// NewAnonymousAuth constructs a TokenAuth for public registries.
+// Anonymous tokens are requested if the registry presents an auth challenge, otherwise no credentials are sent.
+func NewAnonymousAuth() *TokenAuth {
+	a := &TokenAuth{anonymous: true, localCache: utils.NewLRUCache(maxLocalTokens), tokenClient: newTokenClient()}
+	a.SetCredentials("", "")
+	return a
+}
+
+// newTokenClient returns the HTTP client for token requests, sharing the backend transport
+func newTokenClient() *http.Client {
+	return &http.Client{Transport: tracing.Transport(utils.Transport), Timeout: tokenTimeout}
+}
+
+// SetCredentials atomically replaces the credentials exchanged for tokens.
+// Tokens cached for the previous credentials are no longer used.
+func (a *TokenAuth) SetCredentials(user, pass string) {
+	sum := sha256.Sum256([]byte(user + "\x00" + pass))
+	a.creds.Store(&tokenCredentials{username: user, password: pass, fingerprint: hex.EncodeToString(sum[:8])})
 }
 
 // AuthorizationHeader returns an Authorization header to be sent upstream
-func (a *TokenAuth) AuthorizationHeader(bp *BackendProxy, repo string) (string, error) {
+func (a *TokenAuth) AuthorizationHeader(ctx context.Context, bp *BackendProxy, repo string) (string, error) {
 	if a == nil {
 		return "", nil
 	}
 
-	if len(a.username) == 0 || len(a.password) == 0 {
+	creds := a.creds.Load()
+	if !a.anonymous && (len(creds.username) == 0 || len(creds.password) == 0) {
 		return "", errors.New("username and password are not specified")
 	}
 
+	// Check the in-process cache first
+	key := tokenCacheKey(bp.URL, repo, creds.fingerprint)
+	var rawToken string
+	if err := a.localCache.Get(key, &rawToken); err == nil && utils.IsValidToken(rawToken) {
+		metrics.TokenCacheLookups.WithLabelValues("local_hit").Inc()
+		return "Bearer " + rawToken, nil
+	}
+
+	// Collapse concurrent lookups for the same repository into one fetch.
+	// The fetch is detached from the caller so one cancelled request does not fail the others.
+	fetchCtx := context.WithoutCancel(ctx)
+	result, err, _ := a.inflight.Do(key, func() (interface{}, error) {
+		return a.fetchToken(fetchCtx, bp, repo, key, creds)
+	})
+	if errors.Is(err, errNoChallenge) && a.anonymous {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Return the token
+	return "Bearer " + result.(string), nil
+}
+
+// fetchToken returns a token from the shared cache or requests a new one from the backend
+func (a *TokenAuth) fetchToken(ctx context.Context, bp *BackendProxy, repo, key string, creds *tokenCredentials) (string, error) {
 	var rawToken string
 	// Check cache for token
 	if utils.CacheClient != nil {
-		err := utils.CacheClient.Get(repo, &rawToken)
-		if err != nil {
+		err := utils.CacheClient.Get(key, &rawToken)
+		if err != nil && !errors.Is(err, utils.ErrCacheMiss) {
 			logrus.Error(err)
 		}
 	}
 
 	if len(rawToken) == 0 || !utils.IsValidToken(rawToken) {
-		t, err := a.requestToken(bp.URL, repo)
+		metrics.TokenCacheLookups.WithLabelValues("miss").Inc()
+		t, err := a.requestToken(ctx, bp.URL, repo, key, creds)
 		if err != nil {
-			return "", fmt.Errorf("unable to request access token for repo %s: %s", repo, err)
+			metrics.BackendTokenRequests.WithLabelValues("error").Inc()
+			return "", fmt.Errorf("unable to request access token for repo %s: %w", repo, err)
 		}
+		metrics.BackendTokenRequests.WithLabelValues("success").Inc()
 		rawToken = t
+	} else {
+		metrics.TokenCacheLookups.WithLabelValues("hit").Inc()
 	}
 
-	// Return the token
-	return "Bearer " + rawToken, nil
+	if ttl := tokenTTL(rawToken); ttl > 0 {
+		_ = a.localCache.Set(key, rawToken, ttl)
+	}
+	return rawToken, nil
 }
 
-func (a *TokenAuth) requestToken(registryURL string, repo string) (string, error) {
-	// Initialize HTTP client if needed
-	if a.tokenClient == nil {
-		a.tokenClient = &http.Client{}
-	}
+func (a *TokenAuth) requestToken(ctx context.Context, registryURL, repo, key string, creds *tokenCredentials) (token string, err error) {
+	ctx, span := tracing.Start(ctx, "requestToken")
+	defer func() {
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+	span.SetAttributes(attribute.String("repository", repo))
 
 	// Obtain auth challenge from the backend registry
-	registryAsURL, err := url.Parse(registryURL)
-	if err != nil {
-		return "", fmt.Errorf("unable parse registry url: %s", err)
-	}
-
-	registry, err := name.NewRegistry(registryAsURL.Host)
+	challenge, err := a.getChallenge(ctx, registryURL)
 	if err != nil {
-		return "", fmt.Errorf("unable create new registry: %s", err)
-	}
-
-	challenge, err := transport.Ping(context.Background(), registry, a.tokenClient.Transport)
-	if err != nil {
-		return "", fmt.Errorf("unable to get auth challenge from backend registry: %s", err)
-	}
-
-	if len(challenge.Parameters) == 0 {
-		return "", errors.New("no auth challenge presented by backend registry")
+		return "", err
 	}
 
 	// Build token request
-	tokenURL, err := url.Parse(challenge.Parameters["realm"])
-	if err != nil {
-		return "", fmt.Errorf("unable parse token realm url: %s", err)
-	}
-
+	tokenURL := *challenge.realm
 	params := url.Values{}
-	params.Add("service", challenge.Parameters["service"])
+	params.Add("service", challenge.service)
 	params.Add("client_id", "image-rbac-proxy")
-	params.Add("scope", fmt.Sprintf("repository:%s:%s", repo, transport.PullScope))
+	params.Add("scope", pullScope(repo))
 	tokenURL.RawQuery = params.Encode()
 
 	// Get token from the backend registry's auth endpoint.
-	tokenReq, _ := http.NewRequest("GET", tokenURL.String(), nil) // #nosec G704 -- token URL comes from the configured backend registry challenge
-	tokenReq.SetBasicAuth(a.username, a.password)
+	tokenReq, _ := http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil) // #nosec G704 -- token URL comes from the configured backend registry challenge
+	if !a.anonymous {
+		tokenReq.SetBasicAuth(creds.username, creds.password)
+	}
 	resp, err := a.tokenClient.Do(tokenReq) // #nosec G704 -- outbound request to configured registry backend is required for token exchange
 	if err != nil {
+		a.InvalidateChallenge()
 		return "", fmt.Errorf("unable to request token from backend registry: %s", err)
 	}
 
@@ -117,6 +203,8 @@ func (a *TokenAuth) requestToken(registryURL string, repo string) (string, error
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		// The token service may have moved, so rediscover it on the next request
+		a.InvalidateChallenge()
 		return "", fmt.Errorf("invalid status received from token endpoint: %s", body)
 	}
 
@@ -129,16 +217,111 @@ func (a *TokenAuth) requestToken(registryURL string, repo string) (string, error
 	if len(tokenResp.Token) == 0 {
 		return "", fmt.Errorf("no token received in response")
 	}
-	token := tokenResp.Token
+	token = tokenResp.Token
 
-	// Store the token
-	if utils.CacheClient != nil {
-		claims := utils.TokenClaims(token)
-		ttl := claims.ExpiresAt - time.Now().Unix() - 30
-		err = utils.CacheClient.Set(repo, token, int(ttl))
-		if err != nil {
+	// Store the token. Opaque tokens and tokens about to expire have no positive TTL and are not cached,
+	// as a TTL of 0 would keep them forever.
+	if ttl := tokenTTL(token); ttl > 0 && utils.CacheClient != nil {
+		if err := utils.CacheClient.Set(key, token, ttl); err != nil {
 			logrus.Error(err)
 		}
 	}
 	return token, nil
 }
+
+// getChallenge returns the cached auth challenge of the registry, pinging it if the cache is empty or expired
+func (a *TokenAuth) getChallenge(ctx context.Context, registryURL string) (*authChallenge, error) {
+	a.challengeMu.Lock()
+	c := a.challenge
+	a.challengeMu.Unlock()
+	if c == nil || c.registryURL != registryURL || !time.Now().Before(c.expires) {
+		// Collapse concurrent discoveries into one ping
+		result, err, _ := a.inflight.Do("challenge\n"+registryURL, func() (interface{}, error) {
+			return a.discoverChallenge(ctx, registryURL)
+		})
+		if err != nil {
+			return nil, err
+		}
+		c = result.(*authChallenge)
+	}
+	if c.realm == nil {
+		return nil, errNoChallenge
+	}
+	return c, nil
+}
+
+// discoverChallenge pings the registry for its auth challenge and caches it.
+// The challenge of a public registry has no realm.
+func (a *TokenAuth) discoverChallenge(ctx context.Context, registryURL string) (*authChallenge, error) {
+	registryAsURL, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable parse registry url: %s", err)
+	}
+
+	registry, err := name.NewRegistry(registryAsURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable create new registry: %s", err)
+	}
+
+	// The ping uses the bare transport, so bound it like token requests
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	challenge, err := transport.Ping(ctx, registry, a.tokenClient.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get auth challenge from backend registry: %s", err)
+	}
+
+	c := &authChallenge{registryURL: registryURL, expires: time.Now().Add(challengeTTL)}
+	// Without parameters the registry is public and c is remembered without a realm
+	if len(challenge.Parameters) > 0 {
+		realm, err := url.Parse(challenge.Parameters["realm"])
+		if err != nil {
+			return nil, fmt.Errorf("unable parse token realm url: %s", err)
+		}
+		c.realm, c.service = realm, challenge.Parameters["service"]
+	}
+
+	a.challengeMu.Lock()
+	a.challenge = c
+	a.challengeMu.Unlock()
+	return c, nil
+}
+
+// InvalidateToken drops the cached token of a repository so the next request fetches a new one
+func (a *TokenAuth) InvalidateToken(bp *BackendProxy, repo string) {
+	key := tokenCacheKey(bp.URL, repo, a.creds.Load().fingerprint)
+	_ = a.localCache.Delete(key)
+	if utils.CacheClient != nil {
+		if err := utils.CacheClient.Delete(key); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// InvalidateChallenge drops the cached auth challenge so it is rediscovered on the next token request
+func (a *TokenAuth) InvalidateChallenge() {
+	a.challengeMu.Lock()
+	defer a.challengeMu.Unlock()
+	a.challenge = nil
+}
+
+// tokenTTL returns the number of seconds a token can be cached, leaving a margin before it expires.
+// It is 0 for opaque tokens and 0 or less for tokens about to expire, which must not be cached.
+func tokenTTL(token string) int {
+	claims := utils.TokenClaims(token)
+	if claims == nil {
+		return 0
+	}
+	return int(claims.ExpiresAt - time.Now().Unix() - 30)
+}
+
+// pullScope returns the token scope granting pull access to a repository
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:%s", repo, transport.PullScope)
+}
+
+// tokenCacheKey returns the cache key of a backend token.
+// The credential fingerprint separates tokens issued to different credentials.
+func tokenCacheKey(registryURL, repo, fingerprint string) string {
+	return utils.CacheKey("token", registryURL, pullScope(repo), fingerprint)
+}
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -44,9 +47,9 @@ func TestAuthorizationHeader(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	receivedToken, _ := auth.AuthorizationHeader(&bp, "foobar")
+	receivedToken, _ := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 	var cachedToken string
-	if err := utils.CacheClient.Get("foobar", &cachedToken); err != nil {
+	if err := utils.CacheClient.Get(tokenCacheKey(origin.URL, "foobar", auth.creds.Load().fingerprint), &cachedToken); err != nil {
 		t.Fatalf("failed to get cached token: %v", err)
 	}
 
@@ -63,7 +66,7 @@ func TestAuthorizationHeaderNoCreds(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("", "")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "username and password are not specified") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -76,7 +79,7 @@ func TestAuthorizationHeaderBadRegistryName(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "unable parse registry url") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -89,13 +92,60 @@ func TestAuthorizationHeaderNoChallenge(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "no auth challenge presented by backend registry") {
 		t.Errorf("Unexpected error %s", err.Error())
 	}
 }
 
+func TestAnonymousAuthPublicRegistry(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	bp := BackendProxy{URL: origin.URL}
+	header, err := NewAnonymousAuth().AuthorizationHeader(context.Background(), &bp, "foobar")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if header != "" {
+		t.Errorf("Expected no Authorization header, but got %s", header)
+	}
+}
+
+func TestAnonymousAuthToken(t *testing.T) {
+	token := tests.GenToken(time.Now(), "quay")
+	var originServer string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/auth" {
+			if _, _, ok := r.BasicAuth(); ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokenResp, _ := json.Marshal(tokenResponse{Token: token})
+			_, _ = w.Write(tokenResp)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/v2/auth",service="service"`, originServer))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+	originServer = origin.URL
+
+	cacheClient := utils.CacheClient
+	utils.CacheClient = nil
+	defer func() { utils.CacheClient = cacheClient }()
+
+	bp := BackendProxy{URL: origin.URL}
+	header, err := NewAnonymousAuth().AuthorizationHeader(context.Background(), &bp, "foobar")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if header != "Bearer "+token {
+		t.Errorf("Expected anonymous token %s, but got %s", token, header)
+	}
+}
+
 func TestAuthorizationHeaderBadChallenge(t *testing.T) {
 	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -104,7 +154,7 @@ func TestAuthorizationHeaderBadChallenge(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "unable to get auth challenge from backend registry") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -121,7 +171,7 @@ func TestAuthorizationHeaderBadRealm(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "unable parse token realm url") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -138,7 +188,7 @@ func TestAuthorizationHeaderBadTokenEndpoint(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("test", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "unable to request token from backend registry") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -152,7 +202,7 @@ func TestAuthorizationHeaderBadTokenResponse(t *testing.T) {
 
 	bp := BackendProxy{URL: origin.URL}
 	auth := NewTokenAuth("testerror", "test")
-	_, err := auth.AuthorizationHeader(&bp, "foobar")
+	_, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if !strings.Contains(err.Error(), "invalid status received from token endpoint") {
 		t.Errorf("Unexpected error %s", err.Error())
@@ -162,15 +212,201 @@ func TestAuthorizationHeaderBadTokenResponse(t *testing.T) {
 func TestAuthorizationHeaderCachedToken(t *testing.T) {
 	token := tests.GenToken(time.Now(), "quay")
 	utils.CacheClient = &tests.MockCache{}
-	if err := utils.CacheClient.Set("foobar", token, 1); err != nil {
+	auth := NewTokenAuth("test", "test")
+	if err := utils.CacheClient.Set(tokenCacheKey("", "foobar", auth.creds.Load().fingerprint), token, 1); err != nil {
 		t.Fatalf("failed to set cached token: %v", err)
 	}
 
 	bp := BackendProxy{}
-	auth := NewTokenAuth("test", "test")
-	got, _ := auth.AuthorizationHeader(&bp, "foobar")
+	got, _ := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
 
 	if got != "Bearer "+token {
 		t.Errorf("Expected token %s, but got %s", token, got)
 	}
 }
+
+func TestAuthorizationHeaderUncachedTokens(t *testing.T) {
+	cacheClient := utils.CacheClient
+	defer func() { utils.CacheClient = cacheClient }()
+
+	// Opaque tokens and tokens about to expire would be kept forever with a TTL of 0
+	for _, token := range []string{"opaque-token", tests.GenToken(time.Now().Add(-time.Hour+20*time.Second), "quay")} {
+		shared := utils.NewLRUCache(10)
+		utils.CacheClient = shared
+		origin := originAuthServer(token)
+		bp := BackendProxy{URL: origin.URL}
+		auth := NewTokenAuth("test", "test")
+		if _, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar"); err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		origin.Close()
+		if shared.Len() != 0 || auth.localCache.Len() != 0 {
+			t.Errorf("Expected token %s not to be cached, but got %d shared and %d local entries", token, shared.Len(), auth.localCache.Len())
+		}
+	}
+}
+
+func TestAuthorizationHeaderConcurrentRequests(t *testing.T) {
+	token := tests.GenToken(time.Now(), "quay")
+	var tokenRequests atomic.Int32
+	var originServer string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/auth" {
+			tokenRequests.Add(1)
+			// Hold the request so concurrent callers pile up behind it
+			time.Sleep(50 * time.Millisecond)
+			tokenResp, _ := json.Marshal(tokenResponse{Token: token})
+			_, _ = w.Write(tokenResp)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/v2/auth",service="service"`, originServer))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+	originServer = origin.URL
+
+	cacheClient := utils.CacheClient
+	utils.CacheClient = nil
+	defer func() { utils.CacheClient = cacheClient }()
+
+	bp := BackendProxy{URL: origin.URL}
+	auth := NewTokenAuth("test", "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar")
+			if err != nil || got != "Bearer "+token {
+				t.Errorf("Unexpected token %s, error %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := tokenRequests.Load(); n != 1 {
+		t.Errorf("Expected 1 token request, but got %d", n)
+	}
+
+	// Subsequent requests are served from the in-process cache
+	if _, err := auth.AuthorizationHeader(context.Background(), &bp, "foobar"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if n := tokenRequests.Load(); n != 1 {
+		t.Errorf("Expected cached token to be reused, but got %d token requests", n)
+	}
+}
+
+func TestAuthorizationHeaderCachedChallenge(t *testing.T) {
+	token := tests.GenToken(time.Now(), "quay")
+	var pings atomic.Int32
+	var originServer string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/auth" {
+			tokenResp, _ := json.Marshal(tokenResponse{Token: token})
+			_, _ = w.Write(tokenResp)
+			return
+		}
+		pings.Add(1)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/v2/auth",service="service"`, originServer))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+	originServer = origin.URL
+
+	cacheClient := utils.CacheClient
+	utils.CacheClient = nil
+	defer func() { utils.CacheClient = cacheClient }()
+
+	bp := BackendProxy{URL: origin.URL}
+	auth := NewTokenAuth("test", "test")
+	for _, repo := range []string{"repo1", "repo2"} {
+		if _, err := auth.AuthorizationHeader(context.Background(), &bp, repo); err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+	}
+	if n := pings.Load(); n != 1 {
+		t.Errorf("Expected 1 ping, but got %d", n)
+	}
+
+	auth.InvalidateChallenge()
+	if _, err := auth.AuthorizationHeader(context.Background(), &bp, "repo3"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if n := pings.Load(); n != 2 {
+		t.Errorf("Expected challenge to be rediscovered after invalidation, but got %d pings", n)
+	}
+}
+
+func TestGetChallengeConcurrent(t *testing.T) {
+	var pings atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings.Add(1)
+		<-release
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://fakebackend/v2/auth",service="service"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+
+	auth := NewTokenAuth("test", "test")
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() {
+			if _, err := auth.getChallenge(context.Background(), origin.URL); err != nil {
+				t.Errorf("Unexpected error %s", err)
+			}
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := pings.Load(); n != 1 {
+		t.Errorf("Expected concurrent discoveries to share 1 ping, but got %d", n)
+	}
+}
+
+func TestTokenCacheKey(t *testing.T) {
+	key := tokenCacheKey("https://quay.io", "ns/repo", "")
+	if !strings.HasPrefix(key, "image-rbac-proxy:token:") {
+		t.Errorf("Expected default prefix, but got %s", key)
+	}
+	if len(key) > 250 {
+		t.Errorf("Expected key within memcache's limit, but got %d bytes", len(key))
+	}
+	if strings.Contains(key, "ns/repo") {
+		t.Errorf("Expected repository to be hashed, but got %s", key)
+	}
+	if key == tokenCacheKey("https://registry.example.com", "ns/repo", "") {
+		t.Error("Expected keys to differ between backends")
+	}
+
+	t.Setenv("CACHE_KEY_PREFIX", "proxy-a")
+	if key := tokenCacheKey("https://quay.io", "ns/repo", ""); !strings.HasPrefix(key, "proxy-a:token:") {
+		t.Errorf("Expected configured prefix, but got %s", key)
+	}
+}
+
+func TestInvalidateToken(t *testing.T) {
+	token := tests.GenToken(time.Now(), "quay")
+	cacheClient := utils.CacheClient
+	utils.CacheClient = &tests.MockCache{}
+	defer func() { utils.CacheClient = cacheClient }()
+
+	bp := BackendProxy{URL: "https://quay.io"}
+	auth := NewTokenAuth("test", "test")
+	key := tokenCacheKey(bp.URL, "foobar", auth.creds.Load().fingerprint)
+	_ = utils.CacheClient.Set(key, token, 60)
+	_ = auth.localCache.Set(key, token, 60)
+
+	auth.InvalidateToken(&bp, "foobar")
+
+	var cached string
+	if err := utils.CacheClient.Get(key, &cached); err == nil {
+		t.Error("Expected token to be removed from the shared cache")
+	}
+	if err := auth.localCache.Get(key, &cached); err == nil {
+		t.Error("Expected token to be removed from the local cache")
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Redirect modes of a backend
+const (
+	// RedirectPassthrough returns blob redirects to the client, which must be able to reach the storage
+	RedirectPassthrough = "passthrough"
+	// RedirectFollow follows blob redirects and streams the blob to the client
+	RedirectFollow = "follow"
+)
+
+// maxRedirects bounds the number of redirects followed for one request
+const maxRedirects = 10
+
+// redirectTransport follows redirects of GET and HEAD requests instead of returning them.
+// Only the first request goes through the registry transport. Redirected requests use the storage transport and
+// drop the Authorization header once they leave the registry origin, so backend credentials never reach object storage.
+type redirectTransport struct {
+	registry http.RoundTripper
+	storage  http.RoundTripper
+}
+
+// RoundTrip sends the request and follows any redirects of idempotent requests
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.registry.RoundTrip(req)
+	if err != nil || !isRedirect(resp.StatusCode) || !isIdempotent(req) {
+		return resp, err
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	for i := 0; isRedirect(resp.StatusCode); i++ {
+		location, err := resp.Location()
+		if err != nil {
+			// Redirects without a location are returned as is
+			if errors.Is(err, http.ErrNoLocation) {
+				return resp, nil
+			}
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("invalid redirect location: %s", err)
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		if i == maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		next := req.Clone(req.Context())
+		next.URL = location
+		next.Host = ""
+		// Credentials only follow redirects to the same origin, so they are never sent in cleartext after a downgrade
+		if location.Scheme != req.URL.Scheme || location.Host != req.URL.Host {
+			next.Header.Del("Authorization")
+			next.Header.Del("Cookie")
+		}
+		if resp, err = t.storage.RoundTrip(next); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the digest the registry advertised for the blob
+	if digest != "" && resp.Header.Get("Docker-Content-Digest") == "" {
+		resp.Header.Set("Docker-Content-Digest", digest)
+	}
+	return resp, nil
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirects(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("blob"))
+	}))
+	defer storage.Close()
+
+	var originURL string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/foobar/blobs/sha256:storage":
+			w.Header().Set("Docker-Content-Digest", "sha256:storage")
+			http.Redirect(w, r, storage.URL+"/bucket/blob?X-Amz-Signature=sig", http.StatusFound)
+		case "/v2/foobar/blobs/sha256:local":
+			http.Redirect(w, r, "/v2/foobar/blobs/sha256:moved", http.StatusTemporaryRedirect)
+		case "/v2/foobar/blobs/sha256:moved":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("moved"))
+		case "/v2/foobar/blobs/sha256:loop":
+			http.Redirect(w, r, originURL+"/v2/foobar/blobs/sha256:loop", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+	originURL = origin.URL
+
+	redirectTests := []struct {
+		name       string
+		mode       string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantDigest string
+	}{
+		{"Passthrough returns the redirect", "", "/v2/foobar/blobs/sha256:storage", http.StatusFound, "", "sha256:storage"},
+		{"Follow streams from storage without credentials", RedirectFollow, "/v2/foobar/blobs/sha256:storage", http.StatusOK, "blob", "sha256:storage"},
+		{"Follow keeps credentials on the registry host", RedirectFollow, "/v2/foobar/blobs/sha256:local", http.StatusOK, "moved", ""},
+		{"Follow stops redirect loops", RedirectFollow, "/v2/foobar/blobs/sha256:loop", http.StatusServiceUnavailable, "", ""},
+	}
+
+	for _, tt := range redirectTests {
+		t.Run(tt.name, func(t *testing.T) {
+			BackendRegistry = newTestBackend(t, origin.URL, NewBearerAuth("token"), tt.mode)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Expected code %d, but got %d", tt.wantStatus, rr.Code)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %q, but got %q", tt.wantBody, rr.Body.String())
+			}
+			if got := rr.Header().Get("Docker-Content-Digest"); got != tt.wantDigest {
+				t.Errorf("Expected digest %q, but got %q", tt.wantDigest, got)
+			}
+		})
+	}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestRedirectsDowngrade(t *testing.T) {
+	registry := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		header := http.Header{"Location": {"http://registry.example.com/v2/foobar/blobs/sha256:moved"}}
+		return &http.Response{StatusCode: http.StatusFound, Header: header, Body: http.NoBody, Request: r}, nil
+	})
+	var sent http.Header
+	storage := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent = r.Header
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})
+
+	r := httptest.NewRequest("GET", "https://registry.example.com/v2/foobar/blobs/sha256:local", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("Cookie", "session=1")
+	resp, err := (&redirectTransport{registry: registry, storage: storage}).RoundTrip(r)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	_ = resp.Body.Close()
+	if sent.Get("Authorization") != "" || sent.Get("Cookie") != "" {
+		t.Errorf("Expected credentials to be dropped on a redirect from https to http, but got %v", sent)
+	}
+}
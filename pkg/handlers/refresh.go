@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// tokenCache is implemented by BackendAuth types that cache backend tokens
+type tokenCache interface {
+	InvalidateToken(*BackendProxy, string)
+}
+
+// tokenRefreshTransport retries idempotent requests once with a fresh token when the backend rejects the cached one
+type tokenRefreshTransport struct {
+	bp   *BackendProxy
+	base http.RoundTripper
+}
+
+// RoundTrip sends the request, refreshing the token and retrying once on 401
+func (t *tokenRefreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The registry may have changed its token service
+	if c, ok := t.bp.Auth.(challengeCache); ok {
+		c.InvalidateChallenge()
+	}
+
+	tc, ok := t.bp.Auth.(tokenCache)
+	if !ok || !isIdempotent(req) {
+		return resp, nil
+	}
+
+	repo := utils.RepoFromPath(req.URL.Path)
+	tc.InvalidateToken(t.bp, repo)
+	header, err := t.bp.Auth.AuthorizationHeader(req.Context(), t.bp, repo)
+	if err != nil {
+		// Keep the upstream response rather than masking it with a credentials error
+		metrics.BackendTokenRefreshes.WithLabelValues("error").Inc()
+		logrus.Errorf("Unable to refresh credentials for registry backend: %s", err)
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", header)
+	resp, err = t.base.RoundTrip(retry)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		metrics.BackendTokenRefreshes.WithLabelValues("rejected").Inc()
+	} else if err == nil {
+		metrics.BackendTokenRefreshes.WithLabelValues("success").Inc()
+	}
+	return resp, err
+}
+
+// isIdempotent reports whether a request can safely be sent again
+func isIdempotent(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// refreshingAuth hands out a stale token until it is invalidated
+type refreshingAuth struct {
+	token       string
+	fresh       string
+	invalidated int
+}
+
+func (a *refreshingAuth) AuthorizationHeader(_ context.Context, _ *BackendProxy, _ string) (string, error) {
+	return "Bearer " + a.token, nil
+}
+
+func (a *refreshingAuth) InvalidateToken(_ *BackendProxy, _ string) {
+	a.invalidated++
+	a.token = a.fresh
+}
+
+func TestTokenRefresh(t *testing.T) {
+	refreshTests := []struct {
+		name            string
+		method          string
+		fresh           string
+		wantStatus      int
+		wantRequests    int32
+		wantInvalidated int
+	}{
+		{"Refreshed token succeeds", "GET", "valid", http.StatusOK, 2, 1},
+		{"Refreshed HEAD succeeds", "HEAD", "valid", http.StatusOK, 2, 1},
+		{"Refreshed token is rejected", "GET", "revoked", http.StatusUnauthorized, 2, 1},
+		{"Non-idempotent request is not retried", "POST", "valid", http.StatusUnauthorized, 1, 0},
+	}
+
+	for _, tt := range refreshTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if r.Header.Get("Authorization") != "Bearer valid" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer origin.Close()
+
+			auth := &refreshingAuth{token: "stale", fresh: tt.fresh}
+			BackendRegistry = newTestBackend(t, origin.URL, auth, "")
+
+			r := httptest.NewRequest(tt.method, "/v2/foobar/manifests/latest", nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Expected code %d, but got %d", tt.wantStatus, rr.Code)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("Expected %d upstream requests, but got %d", tt.wantRequests, n)
+			}
+			if auth.invalidated != tt.wantInvalidated {
+				t.Errorf("Expected %d invalidations, but got %d", tt.wantInvalidated, auth.invalidated)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// errCircuitOpen is returned without contacting the backend while its circuit breaker is open
+var errCircuitOpen = errors.New("backend registry is unavailable, circuit breaker is open")
+
+// retryPolicy configures retries of failed backend requests
+type retryPolicy struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// retryPolicyFromEnv reads BACKEND_RETRIES, BACKEND_RETRY_BACKOFF and BACKEND_RETRY_MAX_BACKOFF
+func retryPolicyFromEnv() retryPolicy {
+	return retryPolicy{
+		retries:    utils.EnvInt("BACKEND_RETRIES", 2),
+		backoff:    utils.EnvDuration("BACKEND_RETRY_BACKOFF", 100*time.Millisecond),
+		maxBackoff: utils.EnvDuration("BACKEND_RETRY_MAX_BACKOFF", 2*time.Second),
+	}
+}
+
+// delay returns the full jitter backoff before a retry
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff << attempt
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d) // #nosec G404 -- jitter does not need a secure source
+}
+
+// retryTransport retries idempotent requests on connection errors and 5xx responses,
+// reporting every attempt to the backend's circuit breaker
+type retryTransport struct {
+	base    http.RoundTripper
+	policy  retryPolicy
+	breaker *circuitBreaker
+}
+
+// RoundTrip sends the request, retrying with jittered backoff while attempts remain
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += max(t.policy.retries, 0)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if t.breaker != nil && !t.breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away, which says nothing about the backend
+			if t.breaker != nil {
+				t.breaker.cancel()
+			}
+			return resp, err
+		}
+		failed := err != nil || isServerError(resp.StatusCode)
+		if t.breaker != nil {
+			t.breaker.record(!failed)
+		}
+		if !failed || attempt+1 >= attempts {
+			return resp, err
+		}
+
+		reason := "error"
+		if resp != nil {
+			reason = "status"
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+		}
+		metrics.BackendRetries.WithLabelValues(reason).Inc()
+
+		timer := time.NewTimer(t.policy.delay(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isServerError reports whether a status indicates a failing backend
+func isServerError(status int) bool {
+	return status >= http.StatusInternalServerError && status != http.StatusNotImplemented
+}
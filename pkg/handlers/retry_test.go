@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetries(t *testing.T) {
+	t.Setenv("BACKEND_RETRY_BACKOFF", "1ms")
+	t.Setenv("BACKEND_BREAKER_FAILURES", "0")
+
+	retryTests := []struct {
+		name         string
+		method       string
+		failures     int32
+		status       int
+		wantStatus   int
+		wantRequests int32
+	}{
+		{"Transient 503 is retried", "GET", 2, http.StatusServiceUnavailable, http.StatusOK, 3},
+		{"Persistent 502 is returned after retries", "GET", 5, http.StatusBadGateway, http.StatusBadGateway, 3},
+		{"Non-idempotent request is not retried", "POST", 1, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"Client errors are not retried", "GET", 1, http.StatusNotFound, http.StatusNotFound, 1},
+		{"Not implemented is not retried", "HEAD", 1, http.StatusNotImplemented, http.StatusNotImplemented, 1},
+	}
+
+	for _, tt := range retryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer origin.Close()
+
+			BackendRegistry = newTestBackend(t, origin.URL, NewBearerAuth("token"), "")
+			r := httptest.NewRequest(tt.method, "/v2/foobar/manifests/latest", nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(RegistryHandler).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Expected code %d, but got %d", tt.wantStatus, rr.Code)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("Expected %d upstream requests, but got %d", tt.wantRequests, n)
+			}
+		})
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	t.Setenv("BACKEND_RETRY_BACKOFF", "1ms")
+	t.Setenv("BACKEND_BREAKER_FAILURES", "3")
+	t.Setenv("BACKEND_BREAKER_COOLDOWN", "1h")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	origin.Close()
+	BackendRegistry = newTestBackend(t, origin.URL, NewBearerAuth("token"), "")
+	defer func() { BackendRegistry = nil }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(RegistryHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/v2/foobar/manifests/latest", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected code %d, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	// The three failed attempts opened the breaker, so later requests fail fast
+	if BackendRegistry.Ready() {
+		t.Fatal("Expected breaker to be open")
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(RegistryHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/v2/foobar/manifests/latest", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected fast failure with Retry-After, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	ReadyHandler(rr, httptest.NewRequest("GET", "/_ready", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to fail while the breaker is open, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"sync/atomic"
+)
+
+// StaticAuth sends the same Authorization header for every repository
+type StaticAuth struct {
+	header atomic.Pointer[string]
+}
+
+// NewBearerAuth constructs a StaticAuth sending a fixed bearer token
+func NewBearerAuth(token string) *StaticAuth {
+	return newStaticAuth("Bearer " + token)
+}
+
+// NewBasicAuth constructs a StaticAuth passing basic credentials through to registries without a token service
+func NewBasicAuth(user, pass string) *StaticAuth {
+	return newStaticAuth("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+}
+
+func newStaticAuth(header string) *StaticAuth {
+	a := &StaticAuth{}
+	a.header.Store(&header)
+	return a
+}
+
+// AuthorizationHeader returns the fixed Authorization header
+func (a *StaticAuth) AuthorizationHeader(_ context.Context, _ *BackendProxy, _ string) (string, error) {
+	return *a.header.Load(), nil
+}
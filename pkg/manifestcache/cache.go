@@ -0,0 +1,137 @@
+package manifestcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+// MaxManifestSize is the largest manifest stored, keeping items within memcache's item size limit
+const MaxManifestSize = 512 << 10
+
+// digestPattern matches manifest references that are sha256 digests
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// IsDigest reports whether a manifest reference is a digest rather than a tag
+func IsDigest(ref string) bool {
+	return digestPattern.MatchString(ref)
+}
+
+// Digest returns the sha256 digest of a manifest
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Manifest is a manifest as returned by the backend
+type Manifest struct {
+	ContentType string `json:"contentType"`
+	Digest      string `json:"digest"`
+	Body        []byte `json:"body"`
+}
+
+// tagEntry maps a tag to the digest it pointed to when last checked
+type tagEntry struct {
+	Digest    string    `json:"digest"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Cache stores manifests by repository and digest, and the digest each tag resolves to.
+// Manifests are immutable and kept for a long TTL. Tags are trusted for a short TTL and revalidated afterwards.
+type Cache struct {
+	cache  utils.Cache
+	ttl    time.Duration
+	tagTTL time.Duration
+	now    func() time.Time
+}
+
+// New constructs a Cache storing items in cache
+func New(cache utils.Cache, ttl, tagTTL time.Duration) *Cache {
+	return &Cache{cache: cache, ttl: ttl, tagTTL: tagTTL, now: time.Now}
+}
+
+// NewFromEnv constructs a Cache storing items in cache if MANIFEST_CACHE is enabled.
+// Manifests are kept for MANIFEST_CACHE_TTL and tags are revalidated after MANIFEST_CACHE_TAG_TTL.
+func NewFromEnv(cache utils.Cache) *Cache {
+	if !utils.EnvBool("MANIFEST_CACHE", false) || cache == nil {
+		return nil
+	}
+	return New(cache, utils.EnvDuration("MANIFEST_CACHE_TTL", 24*time.Hour), utils.EnvDuration("MANIFEST_CACHE_TAG_TTL", 30*time.Second))
+}
+
+// Manifest returns the cached manifest of a repository
+func (c *Cache) Manifest(repo, digest string) (*Manifest, bool) {
+	var m Manifest
+	if err := c.cache.Get(utils.CacheKey("manifest", repo, digest), &m); err != nil {
+		if !errors.Is(err, utils.ErrCacheMiss) {
+			logrus.Error(err)
+		}
+		return nil, false
+	}
+	return &m, true
+}
+
+// SetManifest stores a manifest of a repository
+func (c *Cache) SetManifest(repo string, m *Manifest) {
+	if len(m.Body) > MaxManifestSize {
+		return
+	}
+	if err := c.cache.Set(utils.CacheKey("manifest", repo, m.Digest), m, int(c.ttl.Seconds())); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// Tag returns the digest a tag resolved to for the Accept header, and whether it is recent enough to be used without revalidation
+func (c *Cache) Tag(repo, tag, accept string) (digest string, fresh bool, ok bool) {
+	var e tagEntry
+	if err := c.cache.Get(tagKey(repo, tag, accept), &e); err != nil {
+		if !errors.Is(err, utils.ErrCacheMiss) {
+			logrus.Error(err)
+		}
+		return "", false, false
+	}
+	return e.Digest, c.now().Sub(e.CheckedAt) < c.tagTTL, true
+}
+
+// SetTag records the digest a tag resolved to for the Accept header
+func (c *Cache) SetTag(repo, tag, accept, digest string) {
+	// Tags are kept as long as manifests so expired entries can still be revalidated
+	e := tagEntry{Digest: digest, CheckedAt: c.now()}
+	if err := c.cache.Set(tagKey(repo, tag, accept), e, int(c.ttl.Seconds())); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// tagKey returns the key of a tag. Registries choose the manifest of a tag by the Accept header, so it is part of the key.
+func tagKey(repo, tag, accept string) string {
+	var types []string
+	for _, t := range strings.Split(accept, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return utils.CacheKey("tag", repo, tag, strings.Join(types, ","))
+}
+
+// Acceptable reports whether a cached manifest's media type satisfies an Accept header
+func Acceptable(accept, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, t := range strings.Split(accept, ",") {
+		t, _, _ = strings.Cut(t, ";")
+		if t = strings.TrimSpace(t); t == "*/*" || t == contentType {
+			return true
+		}
+	}
+	return false
+}
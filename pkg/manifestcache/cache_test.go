@@ -0,0 +1,61 @@
+package manifestcache
+
+import (
+	"testing"
+	"time"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+func TestCache(t *testing.T) {
+	c := New(utils.NewLRUCache(100), time.Hour, 30*time.Second)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	m := &Manifest{ContentType: "application/vnd.oci.image.manifest.v1+json", Digest: Digest([]byte("{}")), Body: []byte("{}")}
+	c.SetManifest("ns/repo", m)
+	if got, ok := c.Manifest("ns/repo", m.Digest); !ok || string(got.Body) != "{}" || got.ContentType != m.ContentType {
+		t.Errorf("Expected cached manifest, got %+v", got)
+	}
+	if _, ok := c.Manifest("ns/other", m.Digest); ok {
+		t.Error("Expected manifests to be cached per repository")
+	}
+
+	c.SetTag("ns/repo", "latest", "b, a", m.Digest)
+	if digest, fresh, ok := c.Tag("ns/repo", "latest", "a,b"); !ok || !fresh || digest != m.Digest {
+		t.Errorf("Expected fresh tag regardless of Accept order, got %s %t %t", digest, fresh, ok)
+	}
+	if _, _, ok := c.Tag("ns/repo", "latest", "c"); ok {
+		t.Error("Expected tags to be cached per Accept header")
+	}
+
+	now = now.Add(time.Minute)
+	if digest, fresh, ok := c.Tag("ns/repo", "latest", "a,b"); !ok || fresh || digest != m.Digest {
+		t.Errorf("Expected stale tag, got %s %t %t", digest, fresh, ok)
+	}
+
+	large := &Manifest{Digest: "sha256:large", Body: make([]byte, MaxManifestSize+1)}
+	c.SetManifest("ns/repo", large)
+	if _, ok := c.Manifest("ns/repo", large.Digest); ok {
+		t.Error("Expected oversized manifest not to be cached")
+	}
+}
+
+func TestAcceptable(t *testing.T) {
+	acceptTests := []struct {
+		accept      string
+		contentType string
+		expected    bool
+	}{
+		{"", "application/vnd.oci.image.index.v1+json", true},
+		{"*/*", "application/vnd.oci.image.index.v1+json", true},
+		{"application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json", "application/vnd.oci.image.index.v1+json", true},
+		{"application/vnd.docker.distribution.manifest.v2+json;q=0.9", "application/vnd.docker.distribution.manifest.v2+json", true},
+		{"application/vnd.docker.distribution.manifest.v2+json", "application/vnd.oci.image.index.v1+json", false},
+	}
+	for _, tt := range acceptTests {
+		if got := Acceptable(tt.accept, tt.contentType); got != tt.expected {
+			t.Errorf("Acceptable(%q, %q) = %t, expected %t", tt.accept, tt.contentType, got, tt.expected)
+		}
+	}
+}
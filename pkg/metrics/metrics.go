@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "image_rbac_proxy"
+
+var (
+	// RequestsTotal counts served HTTP requests by route, method and status
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests served by the proxy.",
+	}, []string{"route", "method", "status"})
+
+	// RequestDuration observes the latency of served HTTP requests
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests served by the proxy.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// ProxiedBytes counts response bytes proxied from the backend registry
+	ProxiedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxied_bytes_total",
+		Help:      "Total number of response bytes proxied from the backend registry.",
+	})
+
+	// BackendRetries counts backend requests retried after an error or 5xx response
+	BackendRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_retries_total",
+		Help:      "Total number of backend requests retried by reason.",
+	}, []string{"reason"})
+
+	// BackendFailovers counts requests moved on to the next mirror after a backend failed
+	BackendFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_failovers_total",
+		Help:      "Total number of requests failed over to the next mirror by failing backend.",
+	}, []string{"backend"})
+
+	// BackendCircuitState tracks the circuit breaker of each backend: 0 closed, 1 half-open, 2 open
+	BackendCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_circuit_breaker_state",
+		Help:      "State of the backend circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"backend"})
+
+	// BackendTokenRequests counts token requests sent to the backend registry
+	BackendTokenRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_token_requests_total",
+		Help:      "Total number of token requests sent to the backend registry.",
+	}, []string{"result"})
+
+	// BackendTokenRefreshes counts tokens refreshed after the backend rejected them
+	BackendTokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_token_refreshes_total",
+		Help:      "Total number of backend tokens refreshed after an upstream 401 by result.",
+	}, []string{"result"})
+
+	// BackendCredentialReloads counts backend credentials reloaded from files or secrets
+	BackendCredentialReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_credential_reloads_total",
+		Help:      "Total number of backend credential reloads by result.",
+	}, []string{"result"})
+
+	// TLSCertificateExpiry tracks when the serving certificate expires
+	TLSCertificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the serving TLS certificate in seconds since the epoch.",
+	})
+
+	// TLSCertificateReloads counts serving certificate reloads
+	TLSCertificateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_certificate_reloads_total",
+		Help:      "Total number of serving TLS certificate reloads by result.",
+	}, []string{"result"})
+
+	// APIKeyVerifications counts API key verifications
+	APIKeyVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_key_verifications_total",
+		Help:      "Total number of API key verifications by result.",
+	}, []string{"result"})
+
+	// AuditEventsDropped counts audit events a sink dropped
+	AuditEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Total number of audit events dropped by sink.",
+	}, []string{"sink"})
+
+	// TokenCacheLookups counts backend token cache hits and misses
+	TokenCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_token_cache_lookups_total",
+		Help:      "Total number of backend token cache lookups by result.",
+	}, []string{"result"})
+
+	// TokenReviews counts TokenReview calls made to the cluster
+	TokenReviews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokenreview_requests_total",
+		Help:      "Total number of TokenReview requests by result.",
+	}, []string{"result"})
+
+	// TokenReviewDuration observes the latency of TokenReview calls
+	TokenReviewDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tokenreview_request_duration_seconds",
+		Help:      "Latency of TokenReview requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// SubjectAccessReviews counts SubjectAccessReview calls made to the cluster
+	SubjectAccessReviews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subjectaccessreview_requests_total",
+		Help:      "Total number of SubjectAccessReview requests by result.",
+	}, []string{"result"})
+
+	// SubjectAccessReviewDuration observes the latency of SubjectAccessReview calls
+	SubjectAccessReviewDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "subjectaccessreview_request_duration_seconds",
+		Help:      "Latency of SubjectAccessReview requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// OIDCVerificationFailures counts ID tokens that failed verification
+	OIDCVerificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oidc_verification_failures_total",
+		Help:      "Total number of OIDC ID token verification failures by reason.",
+	}, []string{"reason"})
+
+	// RateLimitRejections counts requests rejected by rate or concurrency limits
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Total number of requests rejected by rate or concurrency limits by dimension.",
+	}, []string{"dimension", "limit"})
+
+	// BlobCacheLookups counts blob requests served from or stored in the local blob cache
+	BlobCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_cache_lookups_total",
+		Help:      "Total number of blob cache lookups by result.",
+	}, []string{"result"})
+
+	// BlobCacheSize tracks the bytes stored in the local blob cache
+	BlobCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "blob_cache_size_bytes",
+		Help:      "Size of the blobs stored in the local blob cache.",
+	})
+
+	// BlobCacheEvictions counts blobs evicted from the local blob cache
+	BlobCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_cache_evictions_total",
+		Help:      "Total number of blobs evicted from the local blob cache.",
+	})
+
+	// ManifestCacheLookups counts manifest requests served from or stored in the manifest cache
+	ManifestCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "manifest_cache_lookups_total",
+		Help:      "Total number of manifest cache lookups by result.",
+	}, []string{"result"})
+
+	// CacheErrors counts errors returned by the shared cache backend
+	CacheErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_errors_total",
+		Help:      "Total number of cache errors by backend and operation.",
+	}, []string{"backend", "operation"})
+)
+
+// Handler returns the HTTP handler exposing the registered metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+// AccessLog is middleware writing one structured log line per request.
+// Successful blob requests are sampled at the rate set by ACCESS_LOG_BLOB_SAMPLE_RATE.
+func AccessLog(next http.Handler) http.Handler {
+	sampleRate := blobSampleRate()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, info := utils.WithRequestInfo(r.Context())
+		rec := utils.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.StatusCode()
+		if status < http.StatusBadRequest && strings.Contains(r.URL.Path, "/blobs/") && rand.Float64() >= sampleRate { // #nosec G404 -- sampling does not need a secure source
+			return
+		}
+
+		fields := logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       rec.Bytes,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"client_ip":   utils.ClientIP(r),
+			"user_agent":  r.UserAgent(),
+		}
+		if info.Subject != "" {
+			fields["subject"] = info.Subject
+			fields["groups"] = info.Groups
+		}
+		if info.Issuer != "" {
+			fields["issuer_type"] = info.Issuer
+		}
+		if info.Repository != "" {
+			fields["repository"] = info.Repository
+			fields["namespace"] = info.Namespace
+		}
+		if info.Decision != "" {
+			fields["decision"] = info.Decision
+			fields["reason"] = info.Reason
+		}
+		if info.UpstreamStatus != 0 {
+			fields["upstream_status"] = info.UpstreamStatus
+		}
+		logrus.WithFields(fields).Info("access")
+	})
+}
+
+// blobSampleRate reads the fraction of successful blob requests to log
+func blobSampleRate() float64 {
+	value := os.Getenv("ACCESS_LOG_BLOB_SAMPLE_RATE")
+	if value == "" {
+		return 1
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		logrus.Warnf("Ignoring invalid ACCESS_LOG_BLOB_SAMPLE_RATE %q", value)
+		return 1
+	}
+	return rate
+}
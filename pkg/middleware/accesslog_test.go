@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+func TestAccessLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	handler := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := utils.RequestInfoFrom(r.Context())
+		info.Subject, info.Groups, info.Issuer = "user1", []string{"group1"}, utils.IssuerDex
+		info.Repository, info.Namespace = "namespace1/repo1", "repo1"
+		info.Decision, info.Reason = utils.DecisionAllow, "permission_granted"
+		info.UpstreamStatus = http.StatusOK
+		_, _ = w.Write([]byte("manifest"))
+	}))
+
+	r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("Expected an access log entry")
+	}
+	expected := logrus.Fields{
+		"status":          http.StatusOK,
+		"upstream_status": http.StatusOK,
+		"bytes":           int64(8),
+		"client_ip":       "10.0.0.1",
+		"subject":         "user1",
+		"issuer_type":     utils.IssuerDex,
+		"repository":      "namespace1/repo1",
+		"namespace":       "repo1",
+		"decision":        utils.DecisionAllow,
+		"reason":          "permission_granted",
+	}
+	for k, v := range expected {
+		if entry.Data[k] != v {
+			t.Errorf("Expected %s to be %v, but got %v", k, v, entry.Data[k])
+		}
+	}
+}
+
+func TestAccessLogBlobSampling(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	t.Setenv("ACCESS_LOG_BLOB_SAMPLE_RATE", "0")
+
+	samplingTests := []struct {
+		name    string
+		path    string
+		status  int
+		wantLog bool
+	}{
+		{"Successful blob is sampled", "/v2/ns/repo/blobs/sha256:abc", http.StatusOK, false},
+		{"Failed blob is logged", "/v2/ns/repo/blobs/sha256:abc", http.StatusUnauthorized, true},
+		{"Manifest is logged", "/v2/ns/repo/manifests/latest", http.StatusOK, true},
+	}
+
+	for _, tt := range samplingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			handler := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+			if got := len(hook.AllEntries()) > 0; got != tt.wantLog {
+				t.Errorf("Expected logged %t, but got %t", tt.wantLog, got)
+			}
+		})
+	}
+}
@@ -6,73 +6,36 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	authorizationv1 "k8s.io/api/authorization/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
+	"image-rbac-proxy/pkg/apikeys"
+	"image-rbac-proxy/pkg/audit"
 	"image-rbac-proxy/pkg/handlers"
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/tracing"
 	"image-rbac-proxy/pkg/utils"
 )
 
+// BasicAuth accepts the token as the basic auth password, it is set from BASIC_AUTH at startup
+var BasicAuth = true
+
 // Auth is middleware to extract a token from a request and verify if it can access repo
 func Authz(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Enforce auth if needed
 		if strings.HasPrefix(r.URL.Path, "/v2") {
-			logrus.Printf("%s %s", r.Method, r.URL.Path)
-			token := getToken(r)
-
-			// Issue an auth challenge and error if no token
-			if token == "" {
-				challenge := fmt.Sprintf("Bearer realm=\"%s/auth\"", os.Getenv("PROXY_URL"))
-				w.Header().Add("WWW-Authenticate", challenge)
-				utils.ErrorHTTPResponse(w, utils.Unauthorized, "Access to the requested resource is not authorized")
+			info := utils.RequestInfoFrom(r.Context())
+			proceed := authorize(w, r, info)
+			audit.Record(audit.EventAuthorization, r, info)
+			if !proceed {
 				return
-			} else {
-				if r.URL.Path == "/v2/" {
-					return
-				}
-
-				repoName := utils.RepoFromPath(r.URL.Path)
-				if repoName == "" {
-					utils.ErrorHTTPResponse(w, utils.Unauthorized, "Proxy has no access to the requested resource")
-					return
-				}
-				quay_namespace := strings.Split(repoName, "/")[0]
-				ocp_namespace := strings.Split(repoName, "/")[1]
-				if quay_namespace != os.Getenv("BACKEND_NAMESPACE") {
-					utils.ErrorHTTPResponse(w, utils.Unauthorized, "Proxy has no access to "+quay_namespace)
-					return
-				}
-
-				// Get username from token
-				var username string
-				var groups []string
-				claims := utils.TokenClaims(token)
-				if claims != nil {
-					if claims.Issuer == os.Getenv("DEX_URL") {
-						// Verify user's token issued by dex
-						username, groups = handlers.VerifyIDToken(token)
-					} else {
-						// Verify serive account's token issued by OpenShift
-						username = handlers.VerifyServiceAccount(token)
-						groups = append(groups, "system:authenticated")
-					}
-				}
-				if username == "" {
-					utils.ErrorHTTPResponse(w, utils.Unauthorized, "Token is invalid or expired")
-					return
-				}
-
-				// Check permission of the user
-				authorized := verifyUserPremission(username, groups, ocp_namespace)
-				if !authorized {
-					utils.ErrorHTTPResponse(w, utils.Unauthorized, "You do not have permission to read imagerepositories in "+ocp_namespace)
-					return
-				}
 			}
 		}
 
@@ -81,17 +44,110 @@ func Authz(next http.Handler) http.Handler {
 	})
 }
 
-func getToken(r *http.Request) string {
-	token := ""
-	authParts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+// authorize records the authorization decision for the request in info.
+// It returns false if a response has already been written and the request must not be proxied.
+func authorize(w http.ResponseWriter, r *http.Request, info *utils.RequestInfo) bool {
+	token := getToken(r)
+	certUser, certGroups := clientCertIdentity(r)
+
+	// Issue an auth challenge and error if no token or client certificate
+	if token == "" && certUser == "" {
+		info.Decision, info.Reason = utils.DecisionDeny, "missing_token"
+		challenge := fmt.Sprintf("Bearer realm=\"%s/auth\"", utils.ExternalURL(r))
+		w.Header().Add("WWW-Authenticate", challenge)
+		utils.ErrorHTTPResponse(w, utils.Unauthorized, "Access to the requested resource is not authorized")
+		return false
+	}
+	if r.URL.Path == "/v2/" {
+		info.Decision, info.Reason = utils.DecisionAllow, "base_endpoint"
+		return false
+	}
+
+	repoName := utils.RepoFromPath(r.URL.Path)
+	if repoName == "" {
+		info.Decision, info.Reason = utils.DecisionDeny, "unknown_repository"
+		utils.ErrorHTTPResponse(w, utils.Unauthorized, "Proxy has no access to the requested resource")
+		return false
+	}
+	quay_namespace := strings.Split(repoName, "/")[0]
+	ocp_namespace := strings.Split(repoName, "/")[1]
+	info.Repository, info.Namespace = repoName, ocp_namespace
+	if quay_namespace != os.Getenv("BACKEND_NAMESPACE") {
+		info.Decision, info.Reason = utils.DecisionDeny, "backend_namespace_mismatch"
+		utils.ErrorHTTPResponse(w, utils.Unauthorized, "Proxy has no access to "+quay_namespace)
+		return false
+	}
 
-	if strings.ToLower(authParts[0]) == "bearer" {
-		token = authParts[1]
+	// Get username from token, falling back to the client certificate
+	var username string
+	var groups []string
+	claims := utils.TokenClaims(token)
+	if token == "" {
+		username, groups = certUser, certGroups
+		info.Issuer = utils.IssuerClientCert
+	} else if apikeys.IsAPIKey(token) {
+		// Verify API key managed by the proxy
+		key, err := apikeys.DefaultStore.Verify(token)
+		info.Issuer = utils.IssuerAPIKey
+		if err == nil && !key.Allows(ocp_namespace) {
+			info.Subject, info.Groups = key.User, key.Groups
+			info.Decision, info.Reason = utils.DecisionDeny, "namespace_not_allowed"
+			utils.ErrorHTTPResponse(w, utils.Unauthorized, "API key is not allowed to access "+ocp_namespace)
+			return false
+		}
+		if err == nil {
+			username, groups = key.User, key.Groups
+		}
+	} else if claims != nil {
+		if claims.Issuer == os.Getenv("DEX_URL") {
+			// Verify user's token issued by dex
+			username, groups = handlers.VerifyIDToken(r.Context(), token)
+			info.Issuer = utils.IssuerDex
+		} else {
+			// Verify serive account's token issued by OpenShift
+			username = handlers.VerifyServiceAccount(r.Context(), token)
+			groups = append(groups, "system:authenticated")
+			info.Issuer = utils.IssuerServiceAccount
+		}
 	}
-	return token
+	if username == "" {
+		info.Decision, info.Reason = utils.DecisionDeny, "invalid_token"
+		utils.ErrorHTTPResponse(w, utils.Unauthorized, "Token is invalid or expired")
+		return false
+	}
+	info.Subject, info.Groups = username, groups
+
+	// Check permission of the user
+	authorized := verifyUserPremission(r.Context(), username, groups, ocp_namespace)
+	if !authorized {
+		info.Decision, info.Reason = utils.DecisionDeny, "permission_denied"
+		utils.ErrorHTTPResponse(w, utils.Unauthorized, "You do not have permission to read imagerepositories in "+ocp_namespace)
+		return false
+	}
+	info.Decision, info.Reason = utils.DecisionAllow, "permission_granted"
+	return true
 }
 
-func verifyUserPremission(user string, groups []string, namespace string) bool {
+// getToken returns the bearer token of the request.
+// Clients that do not follow the token realm may send the token as the basic auth password instead, unless BasicAuth is false.
+func getToken(r *http.Request) string {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return strings.TrimSpace(credentials)
+	case "basic":
+		if _, password, ok := r.BasicAuth(); ok && BasicAuth {
+			return password
+		}
+	}
+	return ""
+}
+
+func verifyUserPremission(ctx context.Context, user string, groups []string, namespace string) bool {
+	ctx, span := tracing.Start(ctx, "verifyUserPremission")
+	defer span.End()
+	span.SetAttributes(attribute.String("user", user), attribute.String("namespace", namespace))
+
 	authorized := false
 	config := &rest.Config{
 		Host:        os.Getenv("CLUSTER_URL"),
@@ -101,6 +157,7 @@ func verifyUserPremission(user string, groups []string, namespace string) bool {
 	// Create a Kubernetes client
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
+		tracing.RecordError(span, err)
 		logrus.Errorf("Error creating Kubernetes client: %s", err)
 		return authorized
 	}
@@ -124,15 +181,24 @@ func verifyUserPremission(user string, groups []string, namespace string) bool {
 		}
 
 		// Perform the SubjectAccessReview to check the user's permissions
-		sarResponse, err := client.AuthorizationV1().SubjectAccessReviews().Create(context.Background(), sar, metav1.CreateOptions{})
+		start := time.Now()
+		sarResponse, err := client.AuthorizationV1().SubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+		metrics.SubjectAccessReviewDuration.Observe(time.Since(start).Seconds())
 		if err != nil {
+			metrics.SubjectAccessReviews.WithLabelValues("error").Inc()
+			tracing.RecordError(span, err)
 			logrus.Errorf("Error performing SubjectAccessReview: %s", err)
 		}
 		if sarResponse.Status.Allowed {
+			metrics.SubjectAccessReviews.WithLabelValues("allowed").Inc()
 			authorized = true
 			break
 		}
+		if err == nil {
+			metrics.SubjectAccessReviews.WithLabelValues("denied").Inc()
+		}
 	}
 
+	span.SetAttributes(attribute.Bool("allowed", authorized))
 	return authorized
 }
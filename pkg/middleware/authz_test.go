@@ -1,12 +1,22 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"image-rbac-proxy/pkg/apikeys"
 	"image-rbac-proxy/pkg/tests"
+	"image-rbac-proxy/pkg/utils"
 )
 
 var authzHandler = Authz(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -35,6 +45,16 @@ func TestAuthzNoToken(t *testing.T) {
 	}
 }
 
+func TestAuthzNoTokenDerivedRealm(t *testing.T) {
+	t.Setenv("PROXY_URL", "")
+	r := httptest.NewRequest("GET", "http://proxy.example.com/v2/foobar/manifests/latest", nil)
+	rr := httptest.NewRecorder()
+	authzHandler.ServeHTTP(rr, r)
+	if rr.Header().Get("WWW-Authenticate") != "Bearer realm=\"http://proxy.example.com/auth\"" {
+		t.Errorf("Incorrect WWW-Authenticate %s", rr.Header())
+	}
+}
+
 func TestAuthzNoRepo(t *testing.T) {
 	r := httptest.NewRequest("GET", "/v2/", nil)
 	r.Header.Set("Authorization", "Bearer valid-token")
@@ -71,12 +91,12 @@ func TestAuthz(t *testing.T) {
 			name: "Successful authorization",
 			openshiftResponse: []tests.Response{
 				{
-					200,
-					tests.TrResponse(true, "user1"),
+					Code: 200,
+					Body: tests.TrResponse(true, "user1"),
 				},
 				{
-					200,
-					tests.SarResponse(true, "authorized!"),
+					Code: 200,
+					Body: tests.SarResponse(true, "authorized!"),
 				},
 			},
 			wantAuthorized: true,
@@ -85,12 +105,12 @@ func TestAuthz(t *testing.T) {
 			name: "Denied authorization",
 			openshiftResponse: []tests.Response{
 				{
-					200,
-					tests.TrResponse(true, "user1"),
+					Code: 200,
+					Body: tests.TrResponse(true, "user1"),
 				},
 				{
-					200,
-					tests.SarResponse(false, "not authorized!"),
+					Code: 200,
+					Body: tests.SarResponse(false, "not authorized!"),
 				},
 			},
 			wantAuthorized: false,
@@ -99,12 +119,12 @@ func TestAuthz(t *testing.T) {
 			name: "SubjectAccessReview call failure",
 			openshiftResponse: []tests.Response{
 				{
-					200,
-					tests.TrResponse(true, "user1"),
+					Code: 200,
+					Body: tests.TrResponse(true, "user1"),
 				},
 				{
-					500,
-					"Internal server error",
+					Code: 500,
+					Body: "Internal server error",
 				},
 			},
 			wantAuthorized: false,
@@ -127,3 +147,183 @@ func TestAuthz(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthzClientCert(t *testing.T) {
+	t.Setenv("BACKEND_NAMESPACE", "namespace1")
+	node := &x509.Certificate{Subject: pkix.Name{CommonName: "system:node:worker-1", Organization: []string{"system:nodes"}}}
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "kube:admin", Organization: []string{"system:masters", "team-a"}}}
+	defer func() { ClientCert = ClientCertMapping{UserPrefix: DefaultClientCertUserPrefix} }()
+
+	certTests := []struct {
+		name           string
+		mapping        ClientCertMapping
+		state          *tls.ConnectionState
+		sarAllowed     bool
+		wantCode       int
+		wantSubject    string
+		wantGroups     []string
+		wantIssuerType string
+	}{
+		{"Verified certificate is authorized", ClientCert, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{node}}}, true, http.StatusOK, "cert:system:node:worker-1", []string{"system:authenticated"}, utils.IssuerClientCert},
+		{"Verified certificate is denied", ClientCert, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{node}}}, false, http.StatusUnauthorized, "cert:system:node:worker-1", []string{"system:authenticated"}, utils.IssuerClientCert},
+		{"SAN is used without a common name", ClientCert, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{DNSNames: []string{"builder.example.com"}}}}}, true, http.StatusOK, "cert:builder.example.com", []string{"system:authenticated"}, utils.IssuerClientCert},
+		{"Organizations are not groups by default", ClientCert, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{admin}}}, true, http.StatusOK, "cert:kube:admin", []string{"system:authenticated"}, utils.IssuerClientCert},
+		{"Configured groups are assigned", ClientCertMapping{UserPrefix: "ci:", Groups: []string{"builders"}}, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{admin}}}, true, http.StatusOK, "ci:kube:admin", []string{"builders", "system:authenticated"}, utils.IssuerClientCert},
+		{"Organization groups are prefixed", ClientCertMapping{UserPrefix: "cert:", OrganizationGroups: true}, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{admin}}}, true, http.StatusOK, "cert:kube:admin", []string{"cert:system:masters", "cert:team-a", "system:authenticated"}, utils.IssuerClientCert},
+		{"Unverified certificate is ignored", ClientCert, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{node}}, true, http.StatusUnauthorized, "", nil, ""},
+	}
+
+	for _, tt := range certTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ClientCert = tt.mapping
+			server := tests.SimulateOpenShiftMaster([]tests.Response{{}, {Code: 200, Body: tests.SarResponse(tt.sarAllowed, "")}})
+			defer server.Close()
+			t.Setenv("CLUSTER_URL", server.URL)
+
+			r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+			r.TLS = tt.state
+			ctx, info := utils.WithRequestInfo(r.Context())
+			rr := httptest.NewRecorder()
+			authzHandler.ServeHTTP(rr, r.WithContext(ctx))
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("Expected code %d, but got %d", tt.wantCode, rr.Code)
+			}
+			if info.Subject != tt.wantSubject || !slices.Equal(info.Groups, tt.wantGroups) || info.Issuer != tt.wantIssuerType {
+				t.Errorf("Unexpected identity %q %v %q", info.Subject, info.Groups, info.Issuer)
+			}
+		})
+	}
+}
+
+func TestParseClientCertMapping(t *testing.T) {
+	mappingTests := []struct {
+		name       string
+		prefix     string
+		groups     string
+		wantPrefix string
+		wantGroups []string
+		wantErr    bool
+	}{
+		{"Default prefix", "", "", DefaultClientCertUserPrefix, nil, false},
+		{"Custom prefix and groups", "ci:", "builders, readers", "ci:", []string{"builders", "readers"}, false},
+		{"System prefix", "system:", "", "", nil, true},
+		{"System group", "", "system:masters", "", nil, true},
+	}
+
+	for _, tt := range mappingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseClientCertMapping(tt.prefix, tt.groups, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if m.UserPrefix != tt.wantPrefix || !slices.Equal(m.Groups, tt.wantGroups) {
+				t.Errorf("Unexpected mapping %+v", m)
+			}
+		})
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	tokenTests := []struct {
+		name          string
+		authorization string
+		basicAuth     bool
+		want          string
+	}{
+		{"Bearer token", "Bearer abc", true, "abc"},
+		{"Lowercase scheme", "bearer abc", true, "abc"},
+		{"Bearer without token", "Bearer", true, ""},
+		{"Basic password", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:abc")), true, "abc"},
+		{"Basic disabled", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:abc")), false, ""},
+		{"Malformed basic", "Basic !!!", true, ""},
+		{"Unknown scheme", "Digest abc", true, ""},
+		{"No header", "", true, ""},
+	}
+	defer func() { BasicAuth = true }()
+
+	for _, tt := range tokenTests {
+		t.Run(tt.name, func(t *testing.T) {
+			BasicAuth = tt.basicAuth
+			r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if token := getToken(r); token != tt.want {
+				t.Errorf("Expected token %q, but got %q", tt.want, token)
+			}
+		})
+	}
+}
+
+func TestAuthzBasic(t *testing.T) {
+	t.Setenv("BACKEND_NAMESPACE", "namespace1")
+	server := tests.SimulateOpenShiftMaster([]tests.Response{
+		{Code: 200, Body: tests.TrResponse(true, "user1")},
+		{Code: 200, Body: tests.SarResponse(true, "authorized!")},
+	})
+	defer server.Close()
+	t.Setenv("CLUSTER_URL", server.URL)
+
+	r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+	r.SetBasicAuth("user1", tests.GenToken(time.Now(), "bar"))
+	rr := httptest.NewRecorder()
+	authzHandler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestAuthzAPIKey(t *testing.T) {
+	t.Setenv("BACKEND_NAMESPACE", "namespace1")
+	const secret = "0123456789abcdef0123456789abcdef"
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+	apikeys.DefaultStore = apikeys.New(map[string]*apikeys.Key{
+		"ci-bot":     {ID: "ci-bot", Hash: hash, User: "ci-bot", Groups: []string{"ci"}},
+		"restricted": {ID: "restricted", Hash: hash, User: "team-bot", Namespaces: []string{"repo1"}},
+		"elsewhere":  {ID: "elsewhere", Hash: hash, User: "other-bot", Namespaces: []string{"repo2"}},
+	})
+	defer func() { apikeys.DefaultStore = nil }()
+
+	keyTests := []struct {
+		name       string
+		key        string
+		sarAllowed bool
+		wantCode   int
+		wantReason string
+	}{
+		{"Valid key is authorized", "irp_ci-bot_" + secret, true, http.StatusOK, "permission_granted"},
+		{"Valid key is denied", "irp_ci-bot_" + secret, false, http.StatusUnauthorized, "permission_denied"},
+		{"Allowed namespace", "irp_restricted_" + secret, true, http.StatusOK, "permission_granted"},
+		{"Namespace restriction", "irp_elsewhere_" + secret, true, http.StatusUnauthorized, "namespace_not_allowed"},
+		{"Invalid key", "irp_ci-bot_" + strings.Repeat("0", 32), true, http.StatusUnauthorized, "invalid_token"},
+	}
+
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := tests.SimulateOpenShiftMaster([]tests.Response{{}, {Code: 200, Body: tests.SarResponse(tt.sarAllowed, "")}})
+			defer server.Close()
+			t.Setenv("CLUSTER_URL", server.URL)
+
+			r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+			ctx, info := utils.WithRequestInfo(r.Context())
+			rr := httptest.NewRecorder()
+			authzHandler.ServeHTTP(rr, r.WithContext(ctx))
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("Expected code %d, but got %d", tt.wantCode, rr.Code)
+			}
+			if info.Reason != tt.wantReason || info.Issuer != utils.IssuerAPIKey {
+				t.Errorf("Unexpected decision %q by issuer %q", info.Reason, info.Issuer)
+			}
+		})
+	}
+}
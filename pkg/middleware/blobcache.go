@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/blobcache"
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// BlobCache is middleware serving blobs from a local store and storing verified blobs pulled from the backend.
+// It must run after Authz so cached blobs are only served to authorized requests.
+// A blob is only served for a repository once the backend confirmed the repository contains it.
+// The backend must follow redirects, redirects returned to the client are not stored.
+func BlobCache(store *blobcache.Store, next http.Handler) http.Handler {
+	if store == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, digest, ok := blobRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if f, ok := store.Open(digest); ok {
+			defer func() { _ = f.Close() }()
+			if store.Linked(repo, digest) || existsUpstream(next, r) {
+				store.Link(repo, digest)
+				metrics.BlobCacheLookups.WithLabelValues("hit").Inc()
+				serveBlob(w, r, digest, f)
+				return
+			}
+			metrics.BlobCacheLookups.WithLabelValues("unlinked").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metrics.BlobCacheLookups.WithLabelValues("miss").Inc()
+		// Partial and HEAD responses cannot be verified, so only full downloads are stored
+		if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw, err := store.Create(digest)
+		if err != nil {
+			logrus.Error(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		tw := &teeWriter{StatusRecorder: utils.NewStatusRecorder(w), cache: cw}
+		next.ServeHTTP(tw, r)
+		if tw.StatusCode() != http.StatusOK {
+			cw.Abort()
+			return
+		}
+		if err := cw.Commit(); err != nil {
+			logrus.Warn(err)
+			return
+		}
+		store.Link(repo, digest)
+	})
+}
+
+// blobRequest returns the repository and digest of a blob pull
+func blobRequest(r *http.Request) (string, string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", "", false
+	}
+	repo, digest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+	if !ok || repo == "" || !blobcache.ValidDigest(digest) {
+		return "", "", false
+	}
+	return repo, digest, true
+}
+
+// existsUpstream asks the backend whether the blob belongs to the requested repository
+func existsUpstream(next http.Handler, r *http.Request) bool {
+	status, _ := headUpstream(next, r)
+	return status == http.StatusOK
+}
+
+func serveBlob(w http.ResponseWriter, r *http.Request, digest string, f io.ReadSeeker) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", `"`+digest+`"`)
+	// Blobs are immutable, so ServeContent only needs the ETag for conditional and Range requests
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// teeWriter copies a successful response body into the blob cache while streaming it to the client
+type teeWriter struct {
+	*utils.StatusRecorder
+	cache *blobcache.Writer
+}
+
+func (tw *teeWriter) Write(b []byte) (int, error) {
+	n, err := tw.StatusRecorder.Write(b)
+	if tw.StatusCode() == http.StatusOK {
+		_, _ = tw.cache.Write(b[:n])
+	}
+	return n, err
+}
+
+// discardWriter is a ResponseWriter dropping the response
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image-rbac-proxy/pkg/blobcache"
+)
+
+func TestBlobCache(t *testing.T) {
+	const blob = "layer content"
+	sum := sha256.Sum256([]byte(blob))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	store, err := blobcache.NewStore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := map[string]int{}
+	handler := BlobCache(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream[r.Method]++
+		if !strings.HasPrefix(r.URL.Path, "/v2/quay/ns/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(blob))
+		}
+	}))
+
+	request := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// The first pull is proxied and stored
+	if rr := request("/v2/quay/ns/blobs/"+digest, nil); rr.Code != http.StatusOK || rr.Body.String() != blob {
+		t.Fatalf("Unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+	// Later pulls are served from disk
+	rr := request("/v2/quay/ns/blobs/"+digest, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != blob || rr.Header().Get("Docker-Content-Digest") != digest {
+		t.Errorf("Unexpected cached response %d %q", rr.Code, rr.Body.String())
+	}
+	rr = request("/v2/quay/ns/blobs/"+digest, http.Header{"Range": {"bytes=0-4"}})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "layer" {
+		t.Errorf("Unexpected range response %d %q", rr.Code, rr.Body.String())
+	}
+	if upstream[http.MethodGet] != 1 {
+		t.Errorf("Expected 1 upstream pull, got %d", upstream[http.MethodGet])
+	}
+
+	// Other repositories must prove they contain the blob before it is served
+	if rr := request("/v2/quay/other/blobs/"+digest, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected blob of another repository to be checked upstream, got %d", rr.Code)
+	}
+	if upstream[http.MethodHead] != 1 || upstream[http.MethodGet] != 2 {
+		t.Errorf("Unexpected upstream requests %v", upstream)
+	}
+
+	// Responses that do not match the digest are not stored
+	tampered := "sha256:" + strings.Repeat("0", 64)
+	request("/v2/quay/ns/blobs/"+tampered, nil)
+	if f, ok := store.Open(tampered); ok {
+		_ = f.Close()
+		t.Error("Expected unverified blob not to be stored")
+	}
+}
+
+func TestBlobCacheRedirectPassthrough(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	store, err := blobcache.NewStore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := BlobCache(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://cdn.example.com/blob", http.StatusFound)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/quay/ns/blobs/"+digest, nil))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://cdn.example.com/blob" {
+		t.Errorf("Expected the redirect to be returned to the client, got %d", rr.Code)
+	}
+	// The client downloads the blob from the storage, so there is nothing to store
+	if f, ok := store.Open(digest); ok {
+		_ = f.Close()
+		t.Error("Expected redirected blob not to be stored")
+	}
+}
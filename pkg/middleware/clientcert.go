@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"image-rbac-proxy/pkg/utils"
+)
+
+// DefaultClientCertUserPrefix is prepended to client certificate users when no prefix is configured
+const DefaultClientCertUserPrefix = "cert:"
+
+// ClientCertMapping maps verified client certificates to Kubernetes identities.
+// Certificates never map to users or groups reserved by Kubernetes.
+type ClientCertMapping struct {
+	// UserPrefix is prepended to the certificate subject to form the username
+	UserPrefix string
+	// Groups are assigned to every certificate user
+	Groups []string
+	// OrganizationGroups maps each subject organization to a group prefixed with UserPrefix
+	OrganizationGroups bool
+}
+
+// ClientCert is the mapping applied to client certificates, it is set from the environment at startup
+var ClientCert = ClientCertMapping{UserPrefix: DefaultClientCertUserPrefix}
+
+// ParseClientCertMapping validates a prefix and a comma separated list of groups.
+// An empty prefix is replaced by DefaultClientCertUserPrefix and neither may use the system: prefix.
+func ParseClientCertMapping(prefix, groups string, organizationGroups bool) (ClientCertMapping, error) {
+	m := ClientCertMapping{UserPrefix: prefix, OrganizationGroups: organizationGroups}
+	if m.UserPrefix == "" {
+		m.UserPrefix = DefaultClientCertUserPrefix
+	}
+	if strings.HasPrefix(m.UserPrefix, "system:") {
+		return m, fmt.Errorf("client certificate user prefix %q must not start with system:", m.UserPrefix)
+	}
+	for _, group := range strings.Split(groups, ",") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		if strings.HasPrefix(group, "system:") {
+			return m, fmt.Errorf("client certificate group %q must not start with system:", group)
+		}
+		m.Groups = append(m.Groups, group)
+	}
+	return m, nil
+}
+
+// InitClientCertFromEnv sets ClientCert from CLIENT_CERT_USER_PREFIX, CLIENT_CERT_GROUPS and CLIENT_CERT_ORGANIZATION_GROUPS
+func InitClientCertFromEnv() error {
+	m, err := ParseClientCertMapping(os.Getenv("CLIENT_CERT_USER_PREFIX"), os.Getenv("CLIENT_CERT_GROUPS"), utils.EnvBool("CLIENT_CERT_ORGANIZATION_GROUPS", false))
+	if err != nil {
+		return err
+	}
+	ClientCert = m
+	return nil
+}
+
+// clientCertIdentity returns the user and groups of a verified client certificate.
+// The name is the subject common name, or the first DNS or email SAN without one, prefixed with the user prefix.
+func clientCertIdentity(r *http.Request) (string, []string) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" && len(cert.EmailAddresses) > 0 {
+		name = cert.EmailAddresses[0]
+	}
+	if name == "" {
+		return "", nil
+	}
+	groups := append([]string{}, ClientCert.Groups...)
+	if ClientCert.OrganizationGroups {
+		for _, org := range cert.Subject.Organization {
+			groups = append(groups, ClientCert.UserPrefix+org)
+		}
+	}
+	groups = append(groups, "system:authenticated")
+	return ClientCert.UserPrefix + name, groups
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"image-rbac-proxy/pkg/manifestcache"
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// ManifestCache is middleware serving manifests from a cache.
+// Pulls by digest are served from the cache once stored. Pulls by tag are served from the cache while the tag is fresh,
+// and revalidated with a HEAD request to the backend once it is stale.
+// It must run after Authz so cached manifests are only served to authorized requests.
+func ManifestCache(cache *manifestcache.Cache, next http.Handler) http.Handler {
+	if cache == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, ref, ok := manifestRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accept := strings.Join(r.Header.Values("Accept"), ",")
+
+		digest := ref
+		if !manifestcache.IsDigest(ref) {
+			cached, fresh, ok := cache.Tag(repo, ref, accept)
+			if ok && !fresh {
+				// Check whether the tag still points to the cached digest
+				status, header := headUpstream(next, r)
+				if cached = manifestDigest(header); status != http.StatusOK || cached == "" {
+					cached = ""
+				} else {
+					cache.SetTag(repo, ref, accept, cached)
+					metrics.ManifestCacheLookups.WithLabelValues("revalidated").Inc()
+				}
+			}
+			digest = cached
+		}
+
+		if digest != "" {
+			if m, ok := cache.Manifest(repo, digest); ok && manifestcache.Acceptable(accept, m.ContentType) {
+				metrics.ManifestCacheLookups.WithLabelValues("hit").Inc()
+				serveManifest(w, r, m)
+				return
+			}
+		}
+
+		metrics.ManifestCacheLookups.WithLabelValues("miss").Inc()
+		rec := &bufferWriter{StatusRecorder: utils.NewStatusRecorder(w)}
+		next.ServeHTTP(rec, r)
+		if rec.StatusCode() != http.StatusOK {
+			return
+		}
+
+		upstreamDigest := manifestDigest(rec.Header())
+		if r.Method == http.MethodGet && !rec.overflow {
+			body := rec.buf.Bytes()
+			// Only store manifests whose content matches the digest they are addressed by
+			if d := manifestcache.Digest(body); (upstreamDigest == "" || upstreamDigest == d) && (!manifestcache.IsDigest(ref) || ref == d) {
+				cache.SetManifest(repo, &manifestcache.Manifest{ContentType: rec.Header().Get("Content-Type"), Digest: d, Body: body})
+				upstreamDigest = d
+			}
+		}
+		if !manifestcache.IsDigest(ref) && upstreamDigest != "" {
+			cache.SetTag(repo, ref, accept, upstreamDigest)
+		}
+	})
+}
+
+// manifestRequest returns the repository and reference of a manifest pull
+func manifestRequest(r *http.Request) (string, string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", "", false
+	}
+	repo, ref, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+	if !ok || repo == "" || ref == "" || strings.Contains(ref, "/") {
+		return "", "", false
+	}
+	return repo, ref, true
+}
+
+// manifestDigest returns the digest of a manifest response from its Docker-Content-Digest header or ETag
+func manifestDigest(header http.Header) string {
+	for _, d := range []string{header.Get("Docker-Content-Digest"), strings.Trim(header.Get("ETag"), `"`)} {
+		if manifestcache.IsDigest(d) {
+			return d
+		}
+	}
+	return ""
+}
+
+func serveManifest(w http.ResponseWriter, r *http.Request, m *manifestcache.Manifest) {
+	w.Header().Set("Content-Type", m.ContentType)
+	w.Header().Set("Docker-Content-Digest", m.Digest)
+	w.Header().Set("ETag", `"`+m.Digest+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.Body)))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(m.Body))
+}
+
+// headUpstream sends a HEAD request for the resource to the backend, returning its status and headers
+func headUpstream(next http.Handler, r *http.Request) (int, http.Header) {
+	head := r.Clone(r.Context())
+	head.Method = http.MethodHead
+	head.Header.Del("Range")
+	head.Header.Del("If-None-Match")
+	d := discardWriter{header: http.Header{}}
+	rec := utils.NewStatusRecorder(d)
+	next.ServeHTTP(rec, head)
+	return rec.StatusCode(), d.header
+}
+
+// bufferWriter keeps a copy of a response body up to the largest cached manifest while streaming it to the client
+type bufferWriter struct {
+	*utils.StatusRecorder
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	n, err := bw.StatusRecorder.Write(b)
+	if !bw.overflow {
+		if bw.buf.Len()+n > manifestcache.MaxManifestSize {
+			bw.overflow = true
+			bw.buf = bytes.Buffer{}
+		} else {
+			bw.buf.Write(b[:n])
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"image-rbac-proxy/pkg/manifestcache"
+	"image-rbac-proxy/pkg/utils"
+)
+
+const ociManifest = "application/vnd.oci.image.manifest.v1+json"
+
+// manifestBackend serves a tag pointing to one of two manifests and counts requests by method
+type manifestBackend struct {
+	current  string
+	requests map[string]int
+}
+
+func (b *manifestBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.requests[r.Method]++
+	body := b.current
+	if ref := r.URL.Path[len("/v2/quay/ns/manifests/"):]; manifestcache.IsDigest(ref) {
+		if ref != manifestcache.Digest([]byte(body)) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", ociManifest)
+	w.Header().Set("Docker-Content-Digest", manifestcache.Digest([]byte(body)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func TestManifestCache(t *testing.T) {
+	manifestTests := []struct {
+		name         string
+		tagTTL       time.Duration
+		path         string
+		accept       string
+		update       bool
+		wantBody     string
+		wantRequests map[string]int
+	}{
+		{"Fresh tag is served from the cache", time.Hour, "/v2/quay/ns/manifests/latest", "", false, "v1", map[string]int{"GET": 1}},
+		{"Stale tag is revalidated with HEAD", 0, "/v2/quay/ns/manifests/latest", "", false, "v1", map[string]int{"GET": 1, "HEAD": 1}},
+		{"Moved tag is pulled again", 0, "/v2/quay/ns/manifests/latest", "", true, "v2", map[string]int{"GET": 2, "HEAD": 1}},
+		{"Digest is served from the cache", 0, "/v2/quay/ns/manifests/" + manifestcache.Digest([]byte("v1")), "", false, "v1", map[string]int{"GET": 1}},
+		{"Unacceptable media type is pulled again", time.Hour, "/v2/quay/ns/manifests/latest", "application/vnd.docker.distribution.manifest.v2+json", false, "v1", map[string]int{"GET": 2}},
+	}
+
+	for _, tt := range manifestTests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &manifestBackend{current: "v1", requests: map[string]int{}}
+			handler := ManifestCache(manifestcache.New(utils.NewLRUCache(100), time.Hour, tt.tagTTL), backend)
+
+			// Warm the cache
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/quay/ns/manifests/latest", nil))
+			if tt.update {
+				backend.current = "v2"
+			}
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusOK || rr.Body.String() != tt.wantBody {
+				t.Errorf("Expected %q, but got %d %q", tt.wantBody, rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get("Docker-Content-Digest") != manifestcache.Digest([]byte(tt.wantBody)) {
+				t.Errorf("Unexpected digest %s", rr.Header().Get("Docker-Content-Digest"))
+			}
+			for method, n := range tt.wantRequests {
+				if backend.requests[method] != n {
+					t.Errorf("Expected %d %s requests, but got %d", n, method, backend.requests[method])
+				}
+			}
+			if len(backend.requests) != len(tt.wantRequests) {
+				t.Errorf("Unexpected backend requests %v", backend.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// Metrics is middleware recording request counts and latencies for a ServeMux
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := utils.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		// ServeMux records the matched pattern on the request
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.StatusCode())
+		metrics.RequestsTotal.WithLabelValues(route, r.Method, status).Inc()
+		metrics.RequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := Metrics(mux)
+
+	metricTests := []struct {
+		name   string
+		path   string
+		route  string
+		status string
+	}{
+		{"Matched route", "/foo/bar", "/foo/", "418"},
+		{"Unmatched route", "/bar", "unmatched", "404"},
+	}
+
+	for _, tt := range metricTests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metrics.RequestsTotal.WithLabelValues(tt.route, "GET", tt.status)
+			before := testutil.ToFloat64(counter)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("Expected request count to increase by 1, but got %f", got)
+			}
+		})
+	}
+}
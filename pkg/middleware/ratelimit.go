@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/ratelimit"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// ClientRateLimit is middleware enforcing per-client limits.
+// It must run before Authz so flooding clients are rejected before their tokens are verified.
+func ClientRateLimit(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit(limiter, ratelimit.Key{ClientIP: utils.ClientIP(r)}, w, r, next)
+	})
+}
+
+// RateLimit is middleware enforcing per-identity and per-namespace limits.
+// It must run after Authz so the authenticated identity is known.
+func RateLimit(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := utils.RequestInfoFrom(r.Context())
+		key := ratelimit.Key{Namespace: info.Namespace}
+		if info.Subject != "" {
+			key.Identity = info.Issuer + ":" + info.Subject
+		}
+		limit(limiter, key, w, r, next)
+	})
+}
+
+// limit applies the request rate and blob stream limits of key before calling next
+func limit(limiter *ratelimit.Limiter, key ratelimit.Key, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if rejection := limiter.Allow(key); rejection != nil {
+		tooManyRequests(w, rejection, "rate")
+		return
+	}
+
+	if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+		release, rejection := limiter.AcquireBlob(key)
+		if rejection != nil {
+			tooManyRequests(w, rejection, "concurrency")
+			return
+		}
+		defer release()
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+func tooManyRequests(w http.ResponseWriter, rejection *ratelimit.Rejection, limit string) {
+	metrics.RateLimitRejections.WithLabelValues(rejection.Dimension, limit).Inc()
+	retryAfter := int(math.Ceil(rejection.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	utils.ErrorHTTPResponse(w, utils.TooManyRequests, "Too many requests for "+strings.ReplaceAll(rejection.Dimension, "_", " "))
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"image-rbac-proxy/pkg/handlers"
+	"image-rbac-proxy/pkg/ratelimit"
+	"image-rbac-proxy/pkg/tests"
+	"image-rbac-proxy/pkg/utils"
+)
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		Identity: ratelimit.Limits{RequestsPerSecond: 1, Burst: 1},
+	})
+	handler := RateLimit(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func() *httptest.ResponseRecorder {
+		ctx, info := utils.WithRequestInfo(t.Context())
+		info.Subject, info.Issuer, info.Namespace = "user1", utils.IssuerDex, "ns"
+		r := httptest.NewRequest("GET", "/v2/quay/ns/manifests/latest", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	if rr := request(); rr.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	rr := request()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+}
+
+func TestRateLimitBlobConcurrency(t *testing.T) {
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		ClientIP: ratelimit.Limits{MaxConcurrentBlobs: 1},
+	})
+	var nested *httptest.ResponseRecorder
+	var handler http.Handler
+	handler = ClientRateLimit(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A second blob from the same client while this one is streaming is rejected
+		if nested == nil {
+			nested = httptest.NewRecorder()
+			handler.ServeHTTP(nested, httptest.NewRequest("GET", "/v2/quay/ns/blobs/sha256:def", nil))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/quay/ns/blobs/sha256:abc", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if nested.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected code %d, but got %d", http.StatusTooManyRequests, nested.Code)
+	}
+}
+
+func TestClientRateLimitBeforeAuthz(t *testing.T) {
+	t.Setenv("BACKEND_NAMESPACE", "namespace1")
+	var reviews atomic.Int32
+	server := tests.SimulateOpenShiftMaster([]tests.Response{
+		{Code: 200, Body: tests.TrResponse(true, "user1")},
+		{Code: 200, Body: tests.SarResponse(true, "authorized!")},
+	})
+	defer server.Close()
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+	t.Setenv("CLUSTER_URL", counting.URL)
+
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		ClientIP: ratelimit.Limits{RequestsPerSecond: 1, Burst: 1},
+	})
+	handler := ClientRateLimit(limiter, Authz(RateLimit(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))))
+
+	token := tests.GenToken(time.Now(), "bar")
+	request := func() int {
+		r := httptest.NewRequest("GET", "/v2/namespace1/repo1/manifests/latest", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("Expected code %d, but got %d", http.StatusOK, code)
+	}
+	verified := reviews.Load()
+	if verified == 0 {
+		t.Fatal("Expected the first request to be verified by the API server")
+	}
+	for range 5 {
+		if code := request(); code != http.StatusTooManyRequests {
+			t.Fatalf("Expected code %d, but got %d", http.StatusTooManyRequests, code)
+		}
+	}
+	if n := reviews.Load(); n != verified {
+		t.Errorf("Expected rate limited requests not to reach the API server, but got %d more calls", n-verified)
+	}
+}
+
+func TestClientRateLimitAuth(t *testing.T) {
+	var reviews atomic.Int32
+	server := tests.SimulateOpenShiftMaster([]tests.Response{{Code: 200, Body: tests.TrResponse(true, "user1")}})
+	defer server.Close()
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+	t.Setenv("CLUSTER_URL", counting.URL)
+
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		ClientIP: ratelimit.Limits{RequestsPerSecond: 1, Burst: 1},
+	})
+	handler := ClientRateLimit(limiter, http.HandlerFunc(handlers.AuthHandler))
+
+	token := tests.GenToken(time.Now(), "bar")
+	request := func() int {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		r.SetBasicAuth("user1", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("Expected code %d, but got %d", http.StatusOK, code)
+	}
+	verified := reviews.Load()
+	for range 5 {
+		if code := request(); code != http.StatusTooManyRequests {
+			t.Fatalf("Expected code %d, but got %d", http.StatusTooManyRequests, code)
+		}
+	}
+	if n := reviews.Load(); n != verified {
+		t.Errorf("Expected rate limited token requests not to reach the API server, but got %d more calls", n-verified)
+	}
+}
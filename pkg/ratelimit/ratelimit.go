@@ -0,0 +1,224 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/yaml"
+)
+
+// Limits configures a token bucket and a blob stream concurrency limit.
+// Zero values disable the corresponding limit.
+type Limits struct {
+	RequestsPerSecond  float64 `json:"requestsPerSecond,omitempty"`
+	Burst              int     `json:"burst,omitempty"`
+	MaxConcurrentBlobs int     `json:"maxConcurrentBlobs,omitempty"`
+}
+
+// NamespaceLimits overrides the default limits for requests to one namespace
+type NamespaceLimits struct {
+	Identity  *Limits `json:"identity,omitempty"`
+	Namespace *Limits `json:"namespace,omitempty"`
+}
+
+// Config holds the limits applied to each key
+type Config struct {
+	// Identity limits apply to each authenticated user or service account
+	Identity Limits `json:"identity"`
+	// Namespace limits apply to all requests to a namespace combined
+	Namespace Limits `json:"namespace"`
+	// ClientIP limits apply to each client address
+	ClientIP Limits `json:"clientIP"`
+	// Namespaces overrides the identity and namespace limits per namespace
+	Namespaces map[string]NamespaceLimits `json:"namespaces,omitempty"`
+}
+
+// LoadConfig reads a YAML or JSON rate limit configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- config path comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rate limit config: %s", err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse rate limit config: %s", err)
+	}
+	return &cfg, nil
+}
+
+// Key identifies the caller of a request
+type Key struct {
+	Identity  string
+	Namespace string
+	ClientIP  string
+}
+
+// Rejection describes why a request was limited
+type Rejection struct {
+	Dimension  string
+	RetryAfter time.Duration
+}
+
+// idleTimeout is how long an unused limiter is kept before being discarded
+const idleTimeout = 10 * time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+// Limiter enforces request rates and concurrent blob streams per key
+type Limiter struct {
+	cfg       *Config
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter constructs a Limiter
+func NewLimiter(cfg *Config) *Limiter {
+	return &Limiter{cfg: cfg, buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// NewLimiterFromEnv constructs a Limiter from the file at RATE_LIMIT_CONFIG.
+// It returns nil when rate limiting is not configured.
+func NewLimiterFromEnv() (*Limiter, error) {
+	path := os.Getenv("RATE_LIMIT_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimiter(cfg), nil
+}
+
+type dimension struct {
+	name   string
+	key    string
+	limits Limits
+}
+
+func (l *Limiter) dimensions(k Key) []dimension {
+	identity, namespace := l.cfg.Identity, l.cfg.Namespace
+	if override, ok := l.cfg.Namespaces[k.Namespace]; ok {
+		if override.Identity != nil {
+			identity = *override.Identity
+		}
+		if override.Namespace != nil {
+			namespace = *override.Namespace
+		}
+	}
+
+	var dims []dimension
+	if k.ClientIP != "" {
+		dims = append(dims, dimension{"client_ip", "ip/" + k.ClientIP, l.cfg.ClientIP})
+	}
+	if k.Identity != "" {
+		// Identity buckets are scoped to the namespace so overrides do not leak between namespaces
+		dims = append(dims, dimension{"identity", "identity/" + k.Namespace + "/" + k.Identity, identity})
+	}
+	if k.Namespace != "" {
+		dims = append(dims, dimension{"namespace", "namespace/" + k.Namespace, namespace})
+	}
+	return dims
+}
+
+// Allow consumes a token from every bucket the key maps to.
+// No tokens are consumed if any bucket is exhausted.
+func (l *Limiter) Allow(k Key) *Rejection {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	var reservations []*rate.Reservation
+	for _, d := range l.dimensions(k) {
+		if d.limits.RequestsPerSecond <= 0 {
+			continue
+		}
+		b := l.bucket(d, now)
+		res := b.limiter.ReserveN(now, 1)
+		if delay := res.DelayFrom(now); !res.OK() || delay > 0 {
+			res.CancelAt(now)
+			for _, prev := range reservations {
+				prev.CancelAt(now)
+			}
+			if !res.OK() {
+				delay = time.Second
+			}
+			return &Rejection{Dimension: d.name, RetryAfter: delay}
+		}
+		reservations = append(reservations, res)
+	}
+	return nil
+}
+
+// AcquireBlob reserves a concurrent blob stream slot for every bucket the key maps to.
+// The returned function must be called to release the slots once the stream completes.
+func (l *Limiter) AcquireBlob(k Key) (func(), *Rejection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	var acquired []*bucket
+	for _, d := range l.dimensions(k) {
+		if d.limits.MaxConcurrentBlobs <= 0 {
+			continue
+		}
+		b := l.bucket(d, now)
+		if b.active >= d.limits.MaxConcurrentBlobs {
+			for _, prev := range acquired {
+				prev.active--
+			}
+			return nil, &Rejection{Dimension: d.name, RetryAfter: time.Second}
+		}
+		b.active++
+		acquired = append(acquired, b)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		now := l.now()
+		for _, b := range acquired {
+			b.active--
+			b.lastSeen = now
+		}
+	}, nil
+}
+
+// bucket returns the bucket for a dimension, creating it if needed. Callers must hold l.mu.
+func (l *Limiter) bucket(d dimension, now time.Time) *bucket {
+	b, ok := l.buckets[d.key]
+	if !ok {
+		burst := d.limits.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(d.limits.RequestsPerSecond))
+		}
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(d.limits.RequestsPerSecond), burst)}
+		l.buckets[d.key] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// sweep discards idle buckets. Callers must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.active == 0 && now.Sub(b.lastSeen) > idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
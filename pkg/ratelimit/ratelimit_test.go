@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := NewLimiter(&Config{
+		Identity: Limits{RequestsPerSecond: 1, Burst: 2},
+		Namespaces: map[string]NamespaceLimits{
+			"busy": {Identity: &Limits{RequestsPerSecond: 1, Burst: 4}},
+		},
+	})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	allowTests := []struct {
+		name    string
+		key     Key
+		allowed int
+	}{
+		{"Default limits", Key{Identity: "user1", Namespace: "quiet"}, 2},
+		{"Separate identity", Key{Identity: "user2", Namespace: "quiet"}, 2},
+		{"Namespace override", Key{Identity: "user1", Namespace: "busy"}, 4},
+		{"Anonymous is not limited", Key{Namespace: "quiet"}, 10},
+	}
+
+	for _, tt := range allowTests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if limiter.Allow(tt.key) == nil {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("Expected %d allowed requests, but got %d", tt.allowed, allowed)
+			}
+		})
+	}
+
+	rejection := limiter.Allow(Key{Identity: "user1", Namespace: "quiet"})
+	if rejection == nil || rejection.Dimension != "identity" || rejection.RetryAfter <= 0 {
+		t.Errorf("Unexpected rejection %+v", rejection)
+	}
+
+	// Tokens are refilled over time
+	now = now.Add(time.Second)
+	if rejection := limiter.Allow(Key{Identity: "user1", Namespace: "quiet"}); rejection != nil {
+		t.Errorf("Expected request to be allowed after refill, but got %+v", rejection)
+	}
+}
+
+func TestAllowDoesNotConsumeOnRejection(t *testing.T) {
+	limiter := NewLimiter(&Config{
+		ClientIP:  Limits{RequestsPerSecond: 1, Burst: 5},
+		Namespace: Limits{RequestsPerSecond: 1, Burst: 1},
+	})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	if rejection := limiter.Allow(Key{ClientIP: "10.0.0.1", Namespace: "ns"}); rejection != nil {
+		t.Fatalf("Unexpected rejection %+v", rejection)
+	}
+	if rejection := limiter.Allow(Key{ClientIP: "10.0.0.1", Namespace: "ns"}); rejection == nil || rejection.Dimension != "namespace" {
+		t.Fatalf("Expected namespace rejection, but got %+v", rejection)
+	}
+	// The client IP bucket must still have tokens left for other namespaces
+	for i := 0; i < 4; i++ {
+		if rejection := limiter.Allow(Key{ClientIP: "10.0.0.1", Namespace: fmt.Sprintf("other-%d", i)}); rejection != nil {
+			t.Fatalf("Unexpected rejection %+v on request %d", rejection, i)
+		}
+	}
+}
+
+func TestAcquireBlob(t *testing.T) {
+	limiter := NewLimiter(&Config{Identity: Limits{MaxConcurrentBlobs: 2}})
+	key := Key{Identity: "user1", Namespace: "ns"}
+
+	release1, rejection := limiter.AcquireBlob(key)
+	if rejection != nil {
+		t.Fatalf("Unexpected rejection %+v", rejection)
+	}
+	release2, _ := limiter.AcquireBlob(key)
+	if _, rejection := limiter.AcquireBlob(key); rejection == nil {
+		t.Fatal("Expected third concurrent blob to be rejected")
+	}
+
+	release1()
+	release3, rejection := limiter.AcquireBlob(key)
+	if rejection != nil {
+		t.Fatalf("Expected slot to be released, but got %+v", rejection)
+	}
+	release2()
+	release3()
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	config := `
+identity:
+  requestsPerSecond: 10
+  burst: 20
+  maxConcurrentBlobs: 5
+namespaces:
+  team-a:
+    identity:
+      requestsPerSecond: 50
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if cfg.Identity.Burst != 20 || cfg.Namespaces["team-a"].Identity.RequestsPerSecond != 50 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
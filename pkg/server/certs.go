@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+// CertReloader serves a certificate and key pair that is reloaded when the files change.
+// Handshakes pick up the new certificate while established connections are left alone.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	// certPEM and keyPEM are the contents last loaded, compared to detect changes
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// NewCertReloader loads the certificate and key pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// reload loads the certificate and key pair if either file changed.
+// A pair that fails to load, such as one caught halfway through an update, leaves the current certificate in place.
+func (c *CertReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to read certificate: %s", err)
+	}
+	keyPEM, err := os.ReadFile(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to read certificate key: %s", err)
+	}
+	if bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("unable to load certificate: %s", err)
+	}
+	c.cert.Store(&cert)
+	c.certPEM, c.keyPEM = certPEM, keyPEM
+	metrics.TLSCertificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	return true, nil
+}
+
+// Watch polls the certificate files until ctx is done, reloading them when they change
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := c.reload()
+		if err != nil {
+			metrics.TLSCertificateReloads.WithLabelValues("error").Inc()
+			logrus.Errorf("Unable to reload TLS certificate: %s", err)
+			continue
+		}
+		if changed {
+			metrics.TLSCertificateReloads.WithLabelValues("reloaded").Inc()
+			logrus.Printf("Reloaded TLS certificate expiring at %s", c.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
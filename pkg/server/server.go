@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+	"image-rbac-proxy/pkg/utils"
+)
+
+// Listener protocols
+const (
+	// ProtocolHTTPS serves HTTP/1.1 and HTTP/2 over TLS
+	ProtocolHTTPS = "https"
+	// ProtocolHTTP serves HTTP/1.1 without TLS, for use behind a TLS-terminating ingress
+	ProtocolHTTP = "http"
+	// ProtocolH2C serves HTTP/1.1 and HTTP/2 without TLS
+	ProtocolH2C = "h2c"
+)
+
+// DefaultListeners is used when LISTENERS is not set
+const DefaultListeners = "https://0.0.0.0:4000"
+
+// DefaultMetricsAddr is used when METRICS_ADDRESS is not set
+const DefaultMetricsAddr = ":9090"
+
+// Listener is an address served with one protocol
+type Listener struct {
+	Protocol string
+	Addr     string
+}
+
+func (l Listener) String() string {
+	return l.Protocol + "://" + l.Addr
+}
+
+// Config holds the settings shared by all listeners
+type Config struct {
+	Handler  http.Handler
+	ErrorLog *log.Logger
+	// CertFile and KeyFile are required by https listeners and reloaded when they change
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables optional client certificate authentication on https listeners
+	ClientCAFile string
+	// MetricsAddr is the address of the plain HTTP listener serving /metrics, kept off the public listeners
+	MetricsAddr string
+}
+
+// ParseListeners parses a comma separated list of listeners such as "https://0.0.0.0:4000,h2c://:8080"
+func ParseListeners(value string) ([]Listener, error) {
+	var listeners []Listener
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		protocol, addr, ok := strings.Cut(entry, "://")
+		if !ok {
+			return nil, fmt.Errorf("listener %q must be in the form protocol://address", entry)
+		}
+		switch protocol {
+		case ProtocolHTTPS, ProtocolHTTP, ProtocolH2C:
+		default:
+			return nil, fmt.Errorf("unsupported listener protocol %q", protocol)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listener address %q: %s", addr, err)
+		}
+		listeners = append(listeners, Listener{Protocol: protocol, Addr: addr})
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners configured")
+	}
+	return listeners, nil
+}
+
+// ListenersFromEnv reads the listeners from LISTENERS
+func ListenersFromEnv() ([]Listener, error) {
+	value := os.Getenv("LISTENERS")
+	if value == "" {
+		value = DefaultListeners
+	}
+	return ParseListeners(value)
+}
+
+// ConfigFromEnv returns the listener settings with the certificate paths from TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE.
+// Metrics are served on METRICS_ADDRESS, or not at all if it is set to an empty value.
+func ConfigFromEnv(handler http.Handler, errorLog *log.Logger) Config {
+	cfg := Config{Handler: handler, ErrorLog: errorLog, CertFile: "/certs/tls.crt", KeyFile: "/certs/tls.key"}
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cfg.CertFile = certFile
+	}
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		cfg.KeyFile = keyFile
+	}
+	cfg.ClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	cfg.MetricsAddr = DefaultMetricsAddr
+	if addr, ok := os.LookupEnv("METRICS_ADDRESS"); ok {
+		cfg.MetricsAddr = addr
+	}
+	return cfg
+}
+
+// newServer returns the server for a listener with the protocols it accepts
+func newServer(l Listener, cfg Config) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	switch l.Protocol {
+	case ProtocolHTTPS:
+		protocols.SetHTTP2(true)
+	case ProtocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &http.Server{
+		Addr:              l.Addr,
+		Handler:           cfg.Handler,
+		ErrorLog:          cfg.ErrorLog,
+		ReadHeaderTimeout: 10 * time.Second,
+		Protocols:         &protocols,
+	}
+}
+
+// newMetricsServer returns the server for the metrics listener
+func newMetricsServer(cfg Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return newServer(Listener{ProtocolHTTP, cfg.MetricsAddr}, Config{Handler: mux, ErrorLog: cfg.ErrorLog})
+}
+
+// Serve binds every listener and serves requests until one of them fails.
+// The certificate of https listeners is reloaded every TLS_CERT_REFRESH_INTERVAL until ctx is done.
+func Serve(ctx context.Context, listeners []Listener, cfg Config) error {
+	var tlsConfig *tls.Config
+	for _, l := range listeners {
+		if l.Protocol != ProtocolHTTPS || tlsConfig != nil {
+			continue
+		}
+		certs, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		go certs.Watch(ctx, utils.EnvDuration("TLS_CERT_REFRESH_INTERVAL", 30*time.Second))
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		if err := configureClientAuth(tlsConfig, cfg.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, len(listeners)+1)
+	if cfg.MetricsAddr != "" {
+		ln, err := net.Listen("tcp", cfg.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("unable to listen on metrics address %s: %s", cfg.MetricsAddr, err)
+		}
+		srv := newMetricsServer(cfg)
+		logrus.Printf("Serving metrics on %s", cfg.MetricsAddr)
+		go func() { errs <- srv.Serve(ln) }()
+	}
+	for _, l := range listeners {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return fmt.Errorf("unable to listen on %s: %s", l, err)
+		}
+		srv := newServer(l, cfg)
+		if l.Protocol == ProtocolHTTPS {
+			srv.TLSConfig = tlsConfig
+		}
+		logrus.Printf("Listening on %s", l)
+		go func() {
+			if l.Protocol == ProtocolHTTPS {
+				errs <- srv.ServeTLS(ln, "", "")
+			} else {
+				errs <- srv.Serve(ln)
+			}
+		}()
+	}
+	return <-errs
+}
+
+// configureClientAuth verifies client certificates against the CA bundle at caFile, if set.
+// Clients without a certificate are still accepted so they can authenticate with a bearer token.
+func configureClientAuth(tlsConfig *tls.Config, caFile string) error {
+	if caFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(caFile) // #nosec G304 -- CA path comes from trusted configuration
+	if err != nil {
+		return fmt.Errorf("unable to read client CA bundle: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in client CA bundle %s", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	parseTests := []struct {
+		name    string
+		value   string
+		want    []Listener
+		wantErr bool
+	}{
+		{"Single listener", "https://0.0.0.0:4000", []Listener{{ProtocolHTTPS, "0.0.0.0:4000"}}, false},
+		{"Several listeners", "https://:4000, http://:8080,h2c://127.0.0.1:8081", []Listener{{ProtocolHTTPS, ":4000"}, {ProtocolHTTP, ":8080"}, {ProtocolH2C, "127.0.0.1:8081"}}, false},
+		{"Unknown protocol", "grpc://:4000", nil, true},
+		{"Missing protocol", ":4000", nil, true},
+		{"Missing port", "http://localhost", nil, true},
+		{"Empty", " , ", nil, true},
+	}
+
+	for _, tt := range parseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseListeners(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %t, but got %v", tt.wantErr, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %v, but got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Expected %v, but got %v", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServerProtocols(t *testing.T) {
+	protocolTests := []struct {
+		protocol  string
+		wantMajor int
+	}{
+		{ProtocolHTTP, 1},
+		{ProtocolH2C, 2},
+	}
+
+	for _, tt := range protocolTests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := newServer(Listener{tt.protocol, ln.Addr().String()}, Config{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			})
+			go func() { _ = srv.Serve(ln) }()
+			defer func() { _ = srv.Close() }()
+
+			// Prefer HTTP/2 with prior knowledge and fall back to HTTP/1.1
+			var protocols http.Protocols
+			protocols.SetUnencryptedHTTP2(tt.protocol == ProtocolH2C)
+			protocols.SetHTTP1(tt.protocol != ProtocolH2C)
+			client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+			resp, err := client.Get("http://" + ln.Addr().String() + "/_ping")
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			_ = resp.Body.Close()
+			if resp.ProtoMajor != tt.wantMajor {
+				t.Errorf("Expected HTTP/%d, but got %s", tt.wantMajor, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newMetricsServer(Config{MetricsAddr: ln.Addr().String()})
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	pathTests := []struct {
+		path     string
+		wantCode int
+	}{
+		{"/metrics", http.StatusOK},
+		{"/v2/", http.StatusNotFound},
+	}
+	for _, tt := range pathTests {
+		resp, err := http.Get("http://" + ln.Addr().String() + tt.path)
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("Expected code %d for %s, but got %d", tt.wantCode, tt.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestConfigFromEnvMetricsAddr(t *testing.T) {
+	if cfg := ConfigFromEnv(nil, nil); cfg.MetricsAddr != DefaultMetricsAddr {
+		t.Errorf("Expected default metrics address %s, but got %q", DefaultMetricsAddr, cfg.MetricsAddr)
+	}
+	t.Setenv("METRICS_ADDRESS", "")
+	if cfg := ConfigFromEnv(nil, nil); cfg.MetricsAddr != "" {
+		t.Errorf("Expected metrics to be disabled, but got %q", cfg.MetricsAddr)
+	}
+}
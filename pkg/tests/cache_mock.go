@@ -44,3 +44,9 @@ func (c *MockCache) Set(key string, val interface{}, _ int) error {
 
 	return nil
 }
+
+// Delete removes an item from cache
+func (c *MockCache) Delete(key string) error {
+	delete(c.Data, key)
+	return nil
+}
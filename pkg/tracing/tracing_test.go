@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestInit(t *testing.T) {
+	initTests := []struct {
+		name     string
+		exporter string
+		wantErr  bool
+	}{
+		{"Disabled by default", "", false},
+		{"Disabled", "none", false},
+		{"Stdout exporter", "stdout", false},
+		{"Unsupported exporter", "zipkin", true},
+	}
+
+	for _, tt := range initTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_EXPORTER", tt.exporter)
+			shutdown, err := Init(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("Unexpected shutdown error %s", err)
+			}
+		})
+	}
+}
+
+func TestTransportPropagatesTraceContext(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+	if _, err := Init(context.Background()); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer origin.Close()
+
+	ctx, span := Start(context.Background(), "test")
+	req, _ := http.NewRequestWithContext(ctx, "GET", origin.URL, nil)
+	resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+	span.End()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	_ = resp.Body.Close()
+
+	if traceparent == "" {
+		t.Fatal("Expected traceparent header to be sent upstream")
+	}
+	if want := span.SpanContext().TraceID().String(); traceparent[3:35] != want {
+		t.Errorf("Expected trace ID %s in traceparent %s", want, traceparent)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CacheClient is the cache shared by the handlers, nil when caching is disabled
+var CacheClient Cache
+
+// ErrCacheMiss is returned by Get when the key is not cached
+var ErrCacheMiss = errors.New("key does not exist in cache")
+
+// Cache stores JSON-encodable values with a TTL in seconds. A TTL of zero or less never expires.
+type Cache interface {
+	Get(key string, val interface{}) error
+	Set(key string, val interface{}, ttl int) error
+	Delete(key string) error
+}
+
+// InitCacheFromEnv sets CacheClient to the backend selected by CACHE_BACKEND.
+// Supported backends are "memory", "memcache" and "redis". When CACHE_BACKEND is unset,
+// memcache is used if MEMCACHE_SERVERS is set and an in-process cache otherwise.
+// Shared backends must be encrypted with CACHE_ENCRYPTION_KEYS unless CACHE_ENCRYPTION is "disabled",
+// and are fronted by an in-process cache when CACHE_LOCAL_TTL is set.
+// In-process caches hold at most CACHE_MEMORY_SIZE entries and CACHE_MEMORY_MAX_SIZE_MB of data.
+func InitCacheFromEnv() error {
+	backend := os.Getenv("CACHE_BACKEND")
+	servers := splitList(os.Getenv("MEMCACHE_SERVERS"))
+	if backend == "" {
+		backend = "memory"
+		if len(servers) > 0 {
+			backend = "memcache"
+		}
+	}
+
+	var shared Cache
+	switch backend {
+	case "memory":
+		logrus.Info("Using in-process cache")
+		CacheClient = newLocalCacheFromEnv()
+		return nil
+	case "memcache":
+		if len(servers) == 0 {
+			return errors.New("MEMCACHE_SERVERS is not specified")
+		}
+		shared = NewMemcache(servers)
+	case "redis":
+		c, err := NewRedisCacheFromEnv()
+		if err != nil {
+			return err
+		}
+		shared = c
+	default:
+		return fmt.Errorf("unsupported cache backend %q", backend)
+	}
+
+	// Values in shared caches are readable by anyone with access to them, so refuse to store them in plaintext
+	// unless encryption is explicitly disabled
+	if keys := os.Getenv("CACHE_ENCRYPTION_KEYS"); keys != "" {
+		encrypted, err := NewEncryptedCache(shared, keys)
+		if err != nil {
+			return err
+		}
+		shared = encrypted
+	} else if os.Getenv("CACHE_ENCRYPTION") == "disabled" {
+		logrus.Warnf("CACHE_ENCRYPTION is disabled, values in the %s cache are stored unencrypted", backend)
+	} else {
+		return fmt.Errorf("CACHE_ENCRYPTION_KEYS is required for the %s cache, set CACHE_ENCRYPTION=disabled to store values unencrypted", backend)
+	}
+
+	if localTTL := EnvDuration("CACHE_LOCAL_TTL", 0); localTTL > 0 {
+		logrus.Infof("Fronting %s cache with an in-process cache for %s", backend, localTTL)
+		CacheClient = NewLayeredCache(newLocalCacheFromEnv(), shared, int(localTTL.Seconds()))
+		return nil
+	}
+	CacheClient = shared
+	return nil
+}
+
+// newLocalCacheFromEnv constructs the in-process cache bounded by CACHE_MEMORY_SIZE and CACHE_MEMORY_MAX_SIZE_MB
+func newLocalCacheFromEnv() *LRUCache {
+	return NewSizedLRUCache(EnvInt("CACHE_MEMORY_SIZE", 10000), int64(EnvInt("CACHE_MEMORY_MAX_SIZE_MB", 256))<<20)
+}
+
+// CacheKey returns the cache key of an item of a kind identified by parts.
+// Keys are prefixed with CACHE_KEY_PREFIX so proxies can share a cache, and hashed to stay within memcache's key length limit.
+func CacheKey(kind string, parts ...string) string {
+	prefix := os.Getenv("CACHE_KEY_PREFIX")
+	if prefix == "" {
+		prefix = "image-rbac-proxy"
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return prefix + ":" + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
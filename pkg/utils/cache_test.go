@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestInitCacheFromEnv(t *testing.T) {
+	server := miniredis.RunT(t)
+	defer func() { CacheClient = nil }()
+
+	cacheTests := []struct {
+		name     string
+		env      map[string]string
+		wantType string
+		wantErr  bool
+	}{
+		{"Default without memcache servers", map[string]string{"MEMCACHE_SERVERS": ""}, "*utils.LRUCache", false},
+		{"Default with memcache servers", map[string]string{"MEMCACHE_SERVERS": "memcache:11211", "CACHE_ENCRYPTION_KEYS": "k1:" + testKey('a')}, "*utils.EncryptedCache", false},
+		{"Memcache without servers", map[string]string{"CACHE_BACKEND": "memcache", "MEMCACHE_SERVERS": ","}, "", true},
+		{"Memcache without encryption keys", map[string]string{"MEMCACHE_SERVERS": "memcache:11211"}, "", true},
+		{"Memcache with encryption disabled", map[string]string{"MEMCACHE_SERVERS": "memcache:11211", "CACHE_ENCRYPTION": "disabled"}, "utils.memCache", false},
+		{"Redis", map[string]string{"CACHE_BACKEND": "redis", "REDIS_ADDR": server.Addr(), "CACHE_ENCRYPTION_KEYS": "k1:" + testKey('a')}, "*utils.EncryptedCache", false},
+		{"Redis without encryption keys", map[string]string{"CACHE_BACKEND": "redis", "REDIS_ADDR": server.Addr()}, "", true},
+		{"Layered redis", map[string]string{"CACHE_BACKEND": "redis", "REDIS_ADDR": server.Addr(), "CACHE_LOCAL_TTL": "1m", "CACHE_ENCRYPTION_KEYS": "k1:" + testKey('a')}, "*utils.LayeredCache", false},
+		{"Layered redis without encryption keys", map[string]string{"CACHE_BACKEND": "redis", "REDIS_ADDR": server.Addr(), "CACHE_LOCAL_TTL": "1m"}, "", true},
+		{"Unsupported", map[string]string{"CACHE_BACKEND": "etcd"}, "", true},
+	}
+
+	for _, tt := range cacheTests {
+		t.Run(tt.name, func(t *testing.T) {
+			CacheClient = nil
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			err := InitCacheFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if got := fmt.Sprintf("%T", CacheClient); got != tt.wantType {
+				t.Errorf("Expected cache %s, but got %s", tt.wantType, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedVersion prefixes values written by EncryptedCache
+const encryptedVersion = "v1"
+
+// EncryptedCache seals values with AES-GCM before storing them in the wrapped cache.
+// Values are bound to their key so they cannot be swapped between keys.
+// The first key encrypts new values and every key can decrypt, which allows keys to be rotated.
+type EncryptedCache struct {
+	cache   Cache
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewEncryptedCache wraps a cache using keys in the form "id:base64key,id:base64key".
+// Keys must decode to 16, 24 or 32 bytes.
+func NewEncryptedCache(cache Cache, keys string) (*EncryptedCache, error) {
+	c := &EncryptedCache{cache: cache, aeads: map[string]cipher.AEAD{}}
+	for _, item := range splitList(keys) {
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, errors.New("cache encryption keys must be in the form id:base64key")
+		}
+		if _, exists := c.aeads[id]; exists {
+			return nil, fmt.Errorf("duplicate cache encryption key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode cache encryption key %q: %s", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache encryption key %q: %s", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache encryption key %q: %s", id, err)
+		}
+		if c.primary == "" {
+			c.primary = id
+		}
+		c.aeads[id] = aead
+	}
+	if c.primary == "" {
+		return nil, errors.New("no cache encryption keys specified")
+	}
+	return c, nil
+}
+
+// Get retrieves and decrypts a key from the wrapped cache
+func (c *EncryptedCache) Get(key string, val interface{}) error {
+	var sealed string
+	if err := c.cache.Get(key, &sealed); err != nil {
+		return err
+	}
+	parts := strings.SplitN(sealed, ":", 3)
+	if len(parts) != 3 || parts[0] != encryptedVersion {
+		return errors.New("unable to parse encrypted item from cache")
+	}
+	aead, ok := c.aeads[parts[1]]
+	if !ok {
+		return fmt.Errorf("cached item is encrypted with unknown key %q", parts[1])
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(data) < aead.NonceSize() {
+		return errors.New("unable to parse encrypted item from cache")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt item from cache: %s", err)
+	}
+	if err := json.Unmarshal(plain, val); err != nil {
+		return fmt.Errorf("unable to parse item from cache: %s", err)
+	}
+	return nil
+}
+
+// Set encrypts a value with the primary key and stores it in the wrapped cache
+func (c *EncryptedCache) Set(key string, val interface{}, ttl int) error {
+	plain, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("unable to marshal item: %s", err)
+	}
+	aead := c.aeads[c.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("unable to generate nonce: %s", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(key))
+	value := encryptedVersion + ":" + c.primary + ":" + base64.StdEncoding.EncodeToString(sealed)
+	return c.cache.Set(key, value, ttl)
+}
+
+// Delete removes a key from the wrapped cache
+func (c *EncryptedCache) Delete(key string) error {
+	return c.cache.Delete(key)
+}
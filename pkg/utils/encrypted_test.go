@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestEncryptedCache(t *testing.T) {
+	shared := NewLRUCache(10)
+	c, err := NewEncryptedCache(shared, "k1:"+testKey('a'))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	if err := c.Set("a", "secret-token", 0); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	var raw string
+	_ = shared.Get("a", &raw)
+	if strings.Contains(raw, "secret-token") || !strings.HasPrefix(raw, "v1:k1:") {
+		t.Errorf("Expected value to be encrypted, but got %s", raw)
+	}
+
+	var val string
+	if err := c.Get("a", &val); err != nil || val != "secret-token" {
+		t.Fatalf("Unexpected value %s, error %v", val, err)
+	}
+
+	// Values are bound to their key
+	_ = shared.Set("b", raw, 0)
+	if err := c.Get("b", &val); err == nil {
+		t.Error("Expected value copied to another key to fail decryption")
+	}
+}
+
+func TestEncryptedCacheKeyRotation(t *testing.T) {
+	shared := NewLRUCache(10)
+	old, _ := NewEncryptedCache(shared, "k1:"+testKey('a'))
+	_ = old.Set("a", "token", 0)
+
+	rotated, err := NewEncryptedCache(shared, "k2:"+testKey('b')+",k1:"+testKey('a'))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	var val string
+	if err := rotated.Get("a", &val); err != nil || val != "token" {
+		t.Fatalf("Expected value encrypted with the old key to be readable, but got %s, error %v", val, err)
+	}
+
+	_ = rotated.Set("b", "token", 0)
+	var raw string
+	_ = shared.Get("b", &raw)
+	if !strings.HasPrefix(raw, "v1:k2:") {
+		t.Errorf("Expected new values to use the primary key, but got %s", raw)
+	}
+
+	retired, _ := NewEncryptedCache(shared, "k2:"+testKey('b'))
+	if err := retired.Get("a", &val); err == nil {
+		t.Error("Expected value encrypted with a retired key to be unreadable")
+	}
+}
+
+func TestNewEncryptedCacheInvalidKeys(t *testing.T) {
+	keyTests := []struct {
+		name string
+		keys string
+	}{
+		{"No keys", ""},
+		{"Missing id", testKey('a')},
+		{"Bad encoding", "k1:not-base64!"},
+		{"Bad length", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"Duplicate id", "k1:" + testKey('a') + ",k1:" + testKey('b')},
+	}
+
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEncryptedCache(NewLRUCache(1), tt.keys); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
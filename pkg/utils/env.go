@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EnvInt reads an integer from the environment, returning def if unset or invalid
+func EnvInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Warnf("Ignoring invalid %s %q", key, value)
+		return def
+	}
+	return i
+}
+
+// EnvBool reads a boolean from the environment, returning def if unset or invalid
+func EnvBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.Warnf("Ignoring invalid %s %q", key, value)
+		return def
+	}
+	return b
+}
+
+// EnvDuration reads a duration such as "30s" from the environment, returning def if unset or invalid
+func EnvDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Warnf("Ignoring invalid %s %q", key, value)
+		return def
+	}
+	return d
+}
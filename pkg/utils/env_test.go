@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvInt(t *testing.T) {
+	envTests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{"Unset", "", 5},
+		{"Valid", "10", 10},
+		{"Invalid", "ten", 5},
+	}
+
+	for _, tt := range envTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_INT", tt.value)
+			if got := EnvInt("TEST_INT", 5); got != tt.want {
+				t.Errorf("Expected %d, but got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEnvBool(t *testing.T) {
+	envTests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"Unset", "", true},
+		{"Valid", "false", false},
+		{"Invalid", "nope", true},
+	}
+
+	for _, tt := range envTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_BOOL", tt.value)
+			if got := EnvBool("TEST_BOOL", true); got != tt.want {
+				t.Errorf("Expected %t, but got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	envTests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"Unset", "", time.Minute},
+		{"Valid", "30s", 30 * time.Second},
+		{"Invalid", "soon", time.Minute},
+	}
+
+	for _, tt := range envTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_DURATION", tt.value)
+			if got := EnvDuration("TEST_DURATION", time.Minute); got != tt.want {
+				t.Errorf("Expected %s, but got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -23,6 +23,9 @@ const Unauthorized = "UNAUTHORIZED"
 // Unavailable is returned when there is a backend service error
 const Unavailable = "UNAVAILABLE"
 
+// TooManyRequests is returned when a client exceeds its rate limit
+const TooManyRequests = "TOOMANYREQUESTS"
+
 // ErrorString returns a JSON string representation of an ErrorResponse
 func ErrorString(code, msg string) string {
 	e := Error{
@@ -43,6 +46,8 @@ func ErrorHTTPResponse(w http.ResponseWriter, ec string, msg string) {
 		status = http.StatusUnauthorized
 	case Unavailable:
 		status = http.StatusServiceUnavailable
+	case TooManyRequests:
+		status = http.StatusTooManyRequests
 	default:
 		status = http.StatusInternalServerError
 	}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LayeredCache fronts a shared cache with a local one.
+// Values read from the shared cache are kept locally for at most localTTL seconds.
+type LayeredCache struct {
+	local    Cache
+	shared   Cache
+	localTTL int
+}
+
+// NewLayeredCache constructs a LayeredCache
+func NewLayeredCache(local, shared Cache, localTTL int) *LayeredCache {
+	return &LayeredCache{local: local, shared: shared, localTTL: localTTL}
+}
+
+// Get retrieves a key from the local cache, falling back to the shared cache
+func (c *LayeredCache) Get(key string, val interface{}) error {
+	if err := c.local.Get(key, val); err == nil {
+		return nil
+	}
+	if err := c.shared.Get(key, val); err != nil {
+		return err
+	}
+	_ = c.local.Set(key, val, c.localTTL)
+	return nil
+}
+
+// Set stores a key in both caches
+func (c *LayeredCache) Set(key string, val interface{}, ttl int) error {
+	localTTL := c.localTTL
+	if ttl > 0 && ttl < localTTL {
+		localTTL = ttl
+	}
+	if err := c.local.Set(key, val, localTTL); err != nil {
+		return err
+	}
+	return c.shared.Set(key, val, ttl)
+}
+
+// Delete removes a key from both caches
+func (c *LayeredCache) Delete(key string) error {
+	var errs []error
+	if err := c.local.Delete(key); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.shared.Delete(key); err != nil && !errors.Is(err, ErrCacheMiss) {
+		errs = append(errs, fmt.Errorf("unable to delete key from shared cache: %s", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLayeredCache(t *testing.T) {
+	local, shared := NewLRUCache(10), NewLRUCache(10)
+	c := NewLayeredCache(local, shared, 60)
+
+	// Values only in the shared cache are copied locally on read
+	_ = shared.Set("a", "1", 0)
+	var val string
+	if err := c.Get("a", &val); err != nil || val != "1" {
+		t.Fatalf("Unexpected value %s, error %v", val, err)
+	}
+	if err := local.Get("a", &val); err != nil {
+		t.Errorf("Expected a to be cached locally, but got %s", err)
+	}
+
+	// Writes and deletes go to both layers
+	_ = c.Set("b", "2", 30)
+	for _, layer := range []Cache{local, shared} {
+		if err := layer.Get("b", &val); err != nil {
+			t.Errorf("Expected b in both layers, but got %s", err)
+		}
+	}
+	_ = c.Delete("b")
+	for _, layer := range []Cache{local, shared} {
+		if err := layer.Get("b", &val); !errors.Is(err, ErrCacheMiss) {
+			t.Errorf("Expected b to be deleted from both layers, but got %v", err)
+		}
+	}
+
+	if err := c.Get("missing", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected cache miss, but got %v", err)
+	}
+}
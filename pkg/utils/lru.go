@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LRUCache is an in-process cache evicting the least recently used entries beyond its capacity or its size limit
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	// maxBytes bounds the total size of keys and values, unlimited if 0
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRUCache constructs an LRUCache holding at most capacity entries
+func NewLRUCache(capacity int) *LRUCache {
+	return NewSizedLRUCache(capacity, 0)
+}
+
+// NewSizedLRUCache constructs an LRUCache holding at most capacity entries and maxBytes of keys and values.
+// Values larger than maxBytes on their own are not stored.
+func NewSizedLRUCache(capacity int, maxBytes int64) *LRUCache {
+	return &LRUCache{
+		capacity: max(capacity, 1),
+		maxBytes: max(maxBytes, 0),
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get retrieves a key from the cache
+func (c *LRUCache) Get(key string, val interface{}) error {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return ErrCacheMiss
+	}
+	entry := elem.Value.(*lruEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(elem)
+		c.mu.Unlock()
+		return ErrCacheMiss
+	}
+	c.order.MoveToFront(elem)
+	value := entry.value
+	c.mu.Unlock()
+
+	if err := json.Unmarshal(value, val); err != nil {
+		return fmt.Errorf("unable to parse item from cache: %s", err)
+	}
+	return nil
+}
+
+// Set stores a key with the specified TTL
+func (c *LRUCache) Set(key string, val interface{}, ttl int) error {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("unable to marshal item: %s", err)
+	}
+	entry := &lruEntry{key: key, value: bytes}
+	if ttl > 0 {
+		entry.expires = c.now().Add(time.Duration(ttl) * time.Second)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += entry.size()
+	for c.order.Len() > c.capacity || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// Delete removes a key from the cache
+func (c *LRUCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	return nil
+}
+
+// Len returns the number of cached entries, including expired ones not yet evicted
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Size returns the total size of cached keys and values in bytes
+func (c *LRUCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// remove drops an element. Callers must hold c.mu.
+func (c *LRUCache) remove(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// size returns the memory accounted to an entry
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
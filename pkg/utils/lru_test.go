@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := NewLRUCache(2)
+	_ = c.Set("a", "1", 0)
+	_ = c.Set("b", "2", 0)
+
+	// Reading a makes b the least recently used entry
+	var val string
+	if err := c.Get("a", &val); err != nil || val != "1" {
+		t.Fatalf("Unexpected value %s, error %v", val, err)
+	}
+	_ = c.Set("c", "3", 0)
+
+	if err := c.Get("b", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected b to be evicted, but got %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if err := c.Get(key, &val); err != nil {
+			t.Errorf("Expected %s to be cached, but got %s", key, err)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, but got %d", c.Len())
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := NewLRUCache(10)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	_ = c.Set("short", "1", 10)
+	_ = c.Set("forever", "2", 0)
+
+	now = now.Add(11 * time.Second)
+	var val string
+	if err := c.Get("short", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected short to expire, but got %v", err)
+	}
+	if err := c.Get("forever", &val); err != nil {
+		t.Errorf("Expected forever to be cached, but got %s", err)
+	}
+}
+
+func TestLRUCacheDelete(t *testing.T) {
+	c := NewLRUCache(10)
+	_ = c.Set("a", "1", 0)
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	var val string
+	if err := c.Get("a", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected a to be deleted, but got %v", err)
+	}
+}
+
+func TestLRUCacheMaxBytes(t *testing.T) {
+	// Each entry takes 11 bytes: a 1 byte key and a 10 byte JSON string
+	c := NewSizedLRUCache(10, 25)
+	_ = c.Set("a", "12345678", 0)
+	_ = c.Set("b", "12345678", 0)
+	_ = c.Set("c", "12345678", 0)
+
+	var val string
+	if err := c.Get("a", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected a to be evicted, but got %v", err)
+	}
+	if c.Len() != 2 || c.Size() != 22 {
+		t.Errorf("Expected 2 entries of 22 bytes, but got %d of %d bytes", c.Len(), c.Size())
+	}
+
+	// Values larger than the limit are not stored and do not evict other entries
+	_ = c.Set("b", "123456789012345678901234567890", 0)
+	if err := c.Get("b", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected oversized b not to be stored, but got %v", err)
+	}
+	if err := c.Get("c", &val); err != nil {
+		t.Errorf("Expected c to be cached, but got %s", err)
+	}
+	if c.Size() != 11 {
+		t.Errorf("Expected 11 bytes, but got %d", c.Size())
+	}
+}
@@ -7,14 +7,9 @@ import (
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/sirupsen/logrus"
-)
-
-var CacheClient cacheClient
 
-type cacheClient interface {
-	Get(key string, val interface{}) error
-	Set(key string, val interface{}, ttl int) error
-}
+	"image-rbac-proxy/pkg/metrics"
+)
 
 type memCache struct {
 	client *memcache.Client
@@ -27,7 +22,11 @@ func (c memCache) Get(key string, val interface{}) error {
 	}
 
 	item, err := c.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return ErrCacheMiss
+	}
 	if err != nil {
+		metrics.CacheErrors.WithLabelValues("memcache", "get").Inc()
 		return fmt.Errorf("unable to get key from memcache: %s", err)
 	}
 	err = json.Unmarshal(item.Value, val)
@@ -57,15 +56,29 @@ func (c memCache) Set(key string, val interface{}, ttl int) error {
 	}
 	err = c.client.Set(item)
 	if err != nil {
+		metrics.CacheErrors.WithLabelValues("memcache", "set").Inc()
 		return fmt.Errorf("unable to store item: %s", err)
 	}
 	return err
 }
 
-// Generates a memcache client
-func InitCacheClient(servers []string) {
+// Delete removes a key from memcache
+func (c memCache) Delete(key string) error {
+	if c.client == nil {
+		return errors.New("memcached client is not initialized")
+	}
+	err := c.client.Delete(key)
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		metrics.CacheErrors.WithLabelValues("memcache", "delete").Inc()
+		return fmt.Errorf("unable to delete item: %s", err)
+	}
+	return nil
+}
+
+// NewMemcache generates a memcache client
+func NewMemcache(servers []string) Cache {
 	logrus.Infof("Memcache servers: %+v", servers)
-	CacheClient = memCache{
+	return memCache{
 		client: memcache.New(servers...),
 	}
 }
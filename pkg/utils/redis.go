@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+// redisTimeout bounds every cache operation so a slow Redis does not stall requests
+const redisTimeout = 2 * time.Second
+
+type redisCache struct {
+	client *redis.Client
+}
+
+// NewRedisCache constructs a Redis backed cache
+func NewRedisCache(opts *redis.Options) Cache {
+	return redisCache{client: redis.NewClient(opts)}
+}
+
+// NewRedisCacheFromEnv constructs a Redis backed cache from REDIS_* environment variables
+func NewRedisCacheFromEnv() (Cache, error) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return nil, errors.New("REDIS_ADDR is not specified")
+	}
+	opts := &redis.Options{
+		Addr:     addr,
+		Username: os.Getenv("REDIS_USERNAME"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       EnvInt("REDIS_DB", 0),
+	}
+	if EnvBool("REDIS_TLS", false) {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	logrus.Infof("Redis server: %s", addr)
+	return NewRedisCache(opts), nil
+}
+
+// Get retrieves a key from redis
+func (c redisCache) Get(key string, val interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	bytes, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		metrics.CacheErrors.WithLabelValues("redis", "get").Inc()
+		return fmt.Errorf("unable to get key from redis: %s", err)
+	}
+	if err := json.Unmarshal(bytes, val); err != nil {
+		return fmt.Errorf("unable to parse item from redis: %s", err)
+	}
+	return nil
+}
+
+// Set stores a key to redis with specified TTL
+func (c redisCache) Set(key string, val interface{}, ttl int) error {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("unable to marshal item: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := c.client.Set(ctx, key, bytes, time.Duration(max(ttl, 0))*time.Second).Err(); err != nil {
+		metrics.CacheErrors.WithLabelValues("redis", "set").Inc()
+		return fmt.Errorf("unable to store item: %s", err)
+	}
+	return nil
+}
+
+// Delete removes a key from redis
+func (c redisCache) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := c.client.Del(ctx, key).Err(); err != nil {
+		metrics.CacheErrors.WithLabelValues("redis", "delete").Inc()
+		return fmt.Errorf("unable to delete item: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+
+	"image-rbac-proxy/pkg/metrics"
+)
+
+func TestRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	c := NewRedisCache(&redis.Options{Addr: server.Addr()})
+
+	if err := c.Set("a", "1", 10); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	var val string
+	if err := c.Get("a", &val); err != nil || val != "1" {
+		t.Fatalf("Unexpected value %s, error %v", val, err)
+	}
+
+	server.FastForward(11 * time.Second)
+	if err := c.Get("a", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected a to expire, but got %v", err)
+	}
+
+	_ = c.Set("b", "2", 0)
+	if err := c.Delete("b"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if err := c.Get("b", &val); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected b to be deleted, but got %v", err)
+	}
+}
+
+func TestRedisCacheErrors(t *testing.T) {
+	server := miniredis.RunT(t)
+	c := NewRedisCache(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	server.Close()
+
+	errs := metrics.CacheErrors.WithLabelValues("redis", "get")
+	before := testutil.ToFloat64(errs)
+	var val string
+	if err := c.Get("a", &val); err == nil || errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("Expected an error from an unavailable redis, but got %v", err)
+	}
+	if got := testutil.ToFloat64(errs) - before; got != 1 {
+		t.Errorf("Expected 1 redis get error to be counted, but got %v", got)
+	}
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// TrustedProxies are the addresses whose X-Forwarded-* headers are honoured.
+// Forwarded headers are ignored unless it is set.
+var TrustedProxies []netip.Prefix
+
+// Issuer types reported for verified tokens
+const (
+	IssuerDex            = "dex"
+	IssuerServiceAccount = "serviceaccount"
+	IssuerClientCert     = "clientcert"
+	IssuerAPIKey         = "apikey"
+)
+
+// Authorization decisions reported for requests
+const (
+	DecisionAllow = "allow"
+	DecisionDeny  = "deny"
+)
+
+// RequestInfo collects details about a request as it passes through the handlers
+type RequestInfo struct {
+	Subject        string
+	Groups         []string
+	Issuer         string
+	Repository     string
+	Namespace      string
+	Decision       string
+	Reason         string
+	UpstreamStatus int
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo attaches an empty RequestInfo to the context
+func WithRequestInfo(ctx context.Context) (context.Context, *RequestInfo) {
+	info := &RequestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// RequestInfoFrom returns the RequestInfo attached to the context.
+// A detached RequestInfo is returned if none is attached so callers can always record into it.
+func RequestInfoFrom(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %s", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// InitTrustedProxiesFromEnv sets TrustedProxies from TRUSTED_PROXIES
+func InitTrustedProxiesFromEnv() error {
+	prefixes, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	TrustedProxies = prefixes
+	return nil
+}
+
+// isTrustedProxy reports whether an address is one of the TrustedProxies
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the peer that sent the request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromTrustedProxy reports whether the request was sent by one of the TrustedProxies
+func fromTrustedProxy(r *http.Request) bool {
+	return len(TrustedProxies) > 0 && isTrustedProxy(remoteIP(r))
+}
+
+// forwardedValue returns the first value of a X-Forwarded-* header
+func forwardedValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// ClientIP returns the IP address of the client that sent the request.
+// X-Forwarded-For is walked from the right, skipping trusted proxies, so clients cannot spoof their address.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !fromTrustedProxy(r) {
+		return ip
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// RequestScheme returns the scheme the client used, honouring X-Forwarded-Proto from trusted proxies
+func RequestScheme(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		switch proto := strings.ToLower(forwardedValue(r, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// ExternalURL returns the URL clients use to reach the proxy.
+// PROXY_URL takes precedence, otherwise the URL is built from the request and trusted X-Forwarded-* headers.
+func ExternalURL(r *http.Request) string {
+	if proxyURL := os.Getenv("PROXY_URL"); proxyURL != "" {
+		return strings.TrimSuffix(proxyURL, "/")
+	}
+	host := r.Host
+	if fromTrustedProxy(r) {
+		if forwarded := forwardedValue(r, "X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return RequestScheme(r) + "://" + host
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwardedTests := []struct {
+		name       string
+		trusted    bool
+		remoteAddr string
+		tls        bool
+		headers    map[string]string
+		wantIP     string
+		wantURL    string
+	}{
+		{"Direct request", true, "203.0.113.5:1234", true, nil, "203.0.113.5", "https://proxy.example.com"},
+		{"Plain HTTP request", true, "203.0.113.5:1234", false, nil, "203.0.113.5", "http://proxy.example.com"},
+		{"Untrusted peer is ignored", true, "203.0.113.5:1234", false, map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "203.0.113.5", "http://proxy.example.com"},
+		{"Trusted proxy", true, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "198.51.100.7", "https://proxy.example.com"},
+		{"Spoofed hops are skipped", true, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 192.168.1.1"}, "198.51.100.7", "http://proxy.example.com"},
+		{"Forwarded host", true, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "registry.example.com"}, "10.1.2.3", "https://registry.example.com"},
+		{"Invalid protocol is ignored", true, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "ftp"}, "10.1.2.3", "http://proxy.example.com"},
+		{"No trusted proxies", false, "10.1.2.3:1234", false, map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "10.1.2.3", "http://proxy.example.com"},
+	}
+
+	for _, tt := range forwardedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			TrustedProxies = nil
+			if tt.trusted {
+				TrustedProxies = trusted
+			}
+			defer func() { TrustedProxies = nil }()
+
+			r := httptest.NewRequest("GET", "http://proxy.example.com/v2/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.TLS = nil
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if ip := ClientIP(r); ip != tt.wantIP {
+				t.Errorf("Expected client IP %s, but got %s", tt.wantIP, ip)
+			}
+			if u := ExternalURL(r); u != tt.wantURL {
+				t.Errorf("Expected external URL %s, but got %s", tt.wantURL, u)
+			}
+		})
+	}
+}
+
+func TestExternalURLFromEnv(t *testing.T) {
+	t.Setenv("PROXY_URL", "https://proxy.example.com/")
+	r := httptest.NewRequest("GET", "http://localhost:8080/v2/", nil)
+	if u := ExternalURL(r); u != "https://proxy.example.com" {
+		t.Errorf("Expected PROXY_URL to take precedence, but got %s", u)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected an error for an invalid CIDR")
+	}
+	if _, err := ParseTrustedProxies("proxy.local"); err == nil {
+		t.Error("Expected an error for a hostname")
+	}
+	prefixes, err := ParseTrustedProxies("::ffff:10.0.0.1,fd00::/8")
+	if err != nil || len(prefixes) != 2 {
+		t.Fatalf("Unexpected result %v %v", prefixes, err)
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import "net/http"
+
+// StatusRecorder wraps a ResponseWriter to record the status code and body size
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+// NewStatusRecorder wraps a ResponseWriter in a StatusRecorder
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+// WriteHeader records the status code before writing it
+func (rec *StatusRecorder) WriteHeader(code int) {
+	if rec.Status == 0 {
+		rec.Status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the number of bytes written
+func (rec *StatusRecorder) Write(b []byte) (int, error) {
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.Bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (rec *StatusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController
+func (rec *StatusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// StatusCode returns the recorded status, defaulting to 200 if nothing was written
+func (rec *StatusRecorder) StatusCode() int {
+	if rec.Status == 0 {
+		return http.StatusOK
+	}
+	return rec.Status
+}
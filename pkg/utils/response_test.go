@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	recorderTests := []struct {
+		name   string
+		write  func(w http.ResponseWriter)
+		status int
+		bytes  int64
+	}{
+		{
+			name:   "Implicit status",
+			write:  func(w http.ResponseWriter) { _, _ = w.Write([]byte("hello")) },
+			status: http.StatusOK,
+			bytes:  5,
+		},
+		{
+			name: "Explicit status",
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte("not found"))
+			},
+			status: http.StatusNotFound,
+			bytes:  9,
+		},
+		{
+			name:   "No response",
+			write:  func(w http.ResponseWriter) {},
+			status: http.StatusOK,
+			bytes:  0,
+		},
+	}
+
+	for _, tt := range recorderTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := NewStatusRecorder(httptest.NewRecorder())
+			tt.write(rec)
+			if rec.StatusCode() != tt.status {
+				t.Errorf("Expected status %d, but got %d", tt.status, rec.StatusCode())
+			}
+			if rec.Bytes != tt.bytes {
+				t.Errorf("Expected %d bytes, but got %d", tt.bytes, rec.Bytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Transport is the HTTP transport shared by requests to backend registries, nil to use http.DefaultTransport
+var Transport http.RoundTripper
+
+// TransportConfig tunes the transport used for backend registries
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	DisableKeepAlives     bool
+	HTTP2                 bool
+	// CAFile is a PEM bundle of additional CAs trusted for private registries
+	CAFile string
+	// ProxyURL is the proxy for backend requests, defaulting to HTTPS_PROXY and NO_PROXY from the environment
+	ProxyURL string
+}
+
+// DefaultTransportConfig returns the transport settings used when nothing is configured
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:           10 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		HTTP2:                 true,
+	}
+}
+
+// NewTransport constructs a transport from the config
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q", cfg.ProxyURL)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile) // #nosec G304 -- CA path comes from trusted configuration
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(cfg.HTTP2)
+
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+		Protocols:             protocols,
+	}, nil
+}
+
+// InitTransportFromEnv sets Transport from BACKEND_* settings, falling back to DefaultTransportConfig
+func InitTransportFromEnv() error {
+	def := DefaultTransportConfig()
+	cfg := TransportConfig{
+		DialTimeout:           EnvDuration("BACKEND_DIAL_TIMEOUT", def.DialTimeout),
+		KeepAlive:             EnvDuration("BACKEND_KEEPALIVE", def.KeepAlive),
+		TLSHandshakeTimeout:   EnvDuration("BACKEND_TLS_HANDSHAKE_TIMEOUT", def.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: EnvDuration("BACKEND_RESPONSE_HEADER_TIMEOUT", def.ResponseHeaderTimeout),
+		IdleConnTimeout:       EnvDuration("BACKEND_IDLE_CONN_TIMEOUT", def.IdleConnTimeout),
+		MaxIdleConns:          EnvInt("BACKEND_MAX_IDLE_CONNS", def.MaxIdleConns),
+		MaxIdleConnsPerHost:   EnvInt("BACKEND_MAX_IDLE_CONNS_PER_HOST", def.MaxIdleConnsPerHost),
+		MaxConnsPerHost:       EnvInt("BACKEND_MAX_CONNS_PER_HOST", def.MaxConnsPerHost),
+		DisableKeepAlives:     EnvBool("BACKEND_DISABLE_KEEPALIVES", def.DisableKeepAlives),
+		HTTP2:                 EnvBool("BACKEND_HTTP2", def.HTTP2),
+		CAFile:                os.Getenv("BACKEND_CA_FILE"),
+		ProxyURL:              os.Getenv("BACKEND_PROXY_URL"),
+	}
+	t, err := NewTransport(cfg)
+	if err != nil {
+		return err
+	}
+	Transport = t
+	return nil
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTransportCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The private registry is untrusted without the CA bundle
+	transport, err := NewTransport(DefaultTransportConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Error("Expected certificate error without the CA bundle")
+	}
+
+	cfg := DefaultTransportConfig()
+	cfg.CAFile = caFile
+	transport, err = NewTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	cfg := DefaultTransportConfig()
+	cfg.ProxyURL = proxy.URL
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://registry.example.com/v2/")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	_ = resp.Body.Close()
+	if proxied != "http://registry.example.com/v2/" {
+		t.Errorf("Expected request through the proxy, got %q", proxied)
+	}
+}
+
+func TestNewTransportConfig(t *testing.T) {
+	transportTests := []struct {
+		name string
+		cfg  func(*TransportConfig)
+		err  bool
+	}{
+		{"Defaults", func(*TransportConfig) {}, false},
+		{"Invalid proxy", func(c *TransportConfig) { c.ProxyURL = "::" }, true},
+		{"Missing CA bundle", func(c *TransportConfig) { c.CAFile = "/nonexistent/ca.pem" }, true},
+		{"HTTP/2 disabled", func(c *TransportConfig) { c.HTTP2 = false }, false},
+	}
+	for _, tt := range transportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultTransportConfig()
+			tt.cfg(&cfg)
+			transport, err := NewTransport(cfg)
+			if tt.err {
+				if err == nil {
+					t.Error("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err)
+			}
+			if transport.Protocols.HTTP2() != cfg.HTTP2 {
+				t.Errorf("Expected HTTP/2 %t", cfg.HTTP2)
+			}
+			if transport.ResponseHeaderTimeout != cfg.ResponseHeaderTimeout || transport.MaxIdleConnsPerHost != cfg.MaxIdleConnsPerHost {
+				t.Error("Expected config to be applied")
+			}
+		})
+	}
+}
+
+func TestInitTransportFromEnv(t *testing.T) {
+	defer func() { Transport = nil }()
+	t.Setenv("BACKEND_MAX_IDLE_CONNS_PER_HOST", "64")
+	t.Setenv("BACKEND_HTTP2", "false")
+	if err := InitTransportFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	transport := Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 64 || transport.Protocols.HTTP2() {
+		t.Errorf("Expected settings from the environment, got %d idle conns per host, HTTP/2 %t", transport.MaxIdleConnsPerHost, transport.Protocols.HTTP2())
+	}
+}